@@ -0,0 +1,474 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbase/retriever/client"
+	"github.com/couchbase/retriever/logger"
+	"github.com/couchbase/retriever/protocol"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+const API_V2 = "/api/v2"
+const MAX_BODY_SIZE = 1 << 20
+
+// OpenAPI description of the v2 API
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// Error of a v2 request, sent as a JSON body
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// Map an error of the client to the status of the request. Bad requests and
+// unknown targets reported by a module are passed on, modules not answering
+// in time are gateway timeouts and other failures gateway errors
+func moduleError(err error) *apiError {
+	var cerr *client.Error
+	switch {
+	case errors.Is(err, client.ErrModuleNotFound):
+		return newAPIError(http.StatusNotFound, "%s", err.Error())
+	case errors.Is(err, client.ErrTimeout):
+		return newAPIError(http.StatusGatewayTimeout, "%s", err.Error())
+	case errors.As(err, &cerr) && (cerr.Status == protocol.StatusBadRequest || cerr.Status == protocol.StatusNotFound):
+		return newAPIError(cerr.Status, "%s", err.Error())
+	}
+	return newAPIError(http.StatusBadGateway, "%s", err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Send an error as JSON. Errors other than *apiError are internal errors
+func writeError(w http.ResponseWriter, err error) {
+	var aerr *apiError
+	if !errors.As(err, &aerr) {
+		aerr = newAPIError(http.StatusInternalServerError, "%s", err.Error())
+	}
+	writeJSON(w, aerr.Status, aerr)
+}
+
+func isAPIv2(r *http.Request) bool {
+	return r.URL.Path == API_V2 || strings.HasPrefix(r.URL.Path, API_V2+"/")
+}
+
+// Decode a JSON request body into v, rejecting unknown fields
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err == io.EOF {
+		return newAPIError(http.StatusBadRequest, "Missing request body")
+	} else if err != nil {
+		return newAPIError(http.StatusBadRequest, "Invalid request body: %s", err.Error())
+	}
+	return nil
+}
+
+// handles a v2 request, errors are sent by the caller
+type apiHandler func(w http.ResponseWriter, r *http.Request) error
+
+// The methods of a v2 resource. GET is authorized for readers, other methods
+// require the admin role
+type resource map[string]apiHandler
+
+func (res resource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.LogInfo("", LOGGER, "Received %s %s", r.Method, r.URL.Path)
+	handler, ok := res[r.Method]
+	if !ok {
+		methods := make([]string, 0, len(res))
+		for method := range res {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method))
+		return
+	}
+	if !allowed(r, r.Method != http.MethodGet) {
+		writeError(w, newAPIError(http.StatusForbidden, "Forbidden"))
+		return
+	}
+	if err := handler(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// Register the v2 routes. Unknown paths under the prefix get a JSON 404
+func routeAPIv2(r *mux.Router) {
+	routes := []struct {
+		path string
+		res  resource
+	}{
+		{"/openapi.json", resource{http.MethodGet: v2OpenAPI}},
+		{"/modules", resource{http.MethodGet: v2Modules}},
+		{"/modules/{module}", resource{http.MethodGet: v2Module}},
+		{"/modules/{module}/level", resource{http.MethodGet: v2GetLevel, http.MethodPut: v2PutLevel}},
+		{"/modules/{module}/keys", resource{http.MethodGet: v2GetKeys, http.MethodPut: v2PutKeys}},
+		{"/modules/{module}/rotate", resource{http.MethodPost: v2Rotate}},
+		{"/modules/{module}/trace", resource{http.MethodPut: v2PutTrace}},
+		{"/modules/{module}/path", resource{http.MethodPut: v2PutPath}},
+		{"/modules/{module}/logs", resource{http.MethodGet: v2Logs}},
+		{"/modules/{module}/logs/follow", resource{http.MethodGet: v2FollowLog}},
+		{"/modules/{module}/traces/{traceId}", resource{http.MethodGet: v2Trace}},
+		{"/modules/{module}/traces/{traceId}/follow", resource{http.MethodGet: v2FollowTrace}},
+		{"/modules/{module}/stats", resource{http.MethodGet: v2Stats}},
+		{"/modules/{module}/alarms", resource{http.MethodGet: v2Alarms, http.MethodPost: v2AddAlarm,
+			http.MethodDelete: v2ClearAlarms}},
+		{"/modules/{module}/alarms/{name}", resource{http.MethodDelete: v2RemoveAlarm}},
+		{"/files", resource{http.MethodGet: v2Files}},
+	}
+	for _, route := range routes {
+		r.Handle(API_V2+route.path, route.res)
+	}
+	r.PathPrefix(API_V2 + "/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, newAPIError(http.StatusNotFound, "No resource %s", r.URL.Path))
+	})
+}
+
+func v2OpenAPI(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+	return nil
+}
+
+func v2Modules(w http.ResponseWriter, r *http.Request) error {
+	modules, err := cl.Registered()
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, modules)
+	return nil
+}
+
+func v2Module(w http.ResponseWriter, r *http.Request) error {
+	d, err := cl.Lookup(mux.Vars(r)["module"])
+	if err != nil {
+		return moduleError(err)
+	}
+	writeJSON(w, http.StatusOK, d)
+	return nil
+}
+
+func v2GetLevel(w http.ResponseWriter, r *http.Request) error {
+	levels, err := cl.Levels(mux.Vars(r)["module"])
+	if err != nil {
+		return moduleError(err)
+	}
+	writeJSON(w, http.StatusOK, levels)
+	return nil
+}
+
+// Body of PUT level. Keys set to "global" follow the module level
+type levelRequest struct {
+	Level string            `json:"level"`
+	Keys  map[string]string `json:"keys"`
+}
+
+// Component keys are sent to modules in comma or space separated lists
+func validKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, ", \t\r\n=")
+}
+
+// Error of an update a module applied in part, the request having been
+// validated before sending it
+func partialError(err error, format string, args ...interface{}) *apiError {
+	merr := moduleError(err)
+	merr.Message = fmt.Sprintf(format, args...) + ": " + merr.Message
+	return merr
+}
+
+// Set the module level and key levels. The request is validated as a whole
+// before anything is sent to the module
+func v2PutLevel(w http.ResponseWriter, r *http.Request) error {
+	module := mux.Vars(r)["module"]
+	req := levelRequest{}
+	if err := decodeBody(w, r, &req); err != nil {
+		return err
+	}
+
+	var spec []string
+	if req.Level != "" {
+		if level, err := logger.ParseLogLevel(req.Level); err != nil || level == logger.LevelGlobal {
+			return newAPIError(http.StatusBadRequest, "Invalid level %q", req.Level)
+		}
+		spec = append(spec, req.Level)
+	}
+	keys := make([]string, 0, len(req.Keys))
+	for key, level := range req.Keys {
+		if !validKey(key) {
+			return newAPIError(http.StatusBadRequest, "Invalid key %q", key)
+		}
+		if _, err := logger.ParseLogLevel(level); err != nil {
+			return newAPIError(http.StatusBadRequest, "Invalid level %q for key %s", level, key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		spec = append(spec, key+"="+req.Keys[key])
+	}
+	if len(spec) == 0 {
+		return newAPIError(http.StatusBadRequest, "One of level or keys required")
+	}
+
+	// the module applies the levels one at a time
+	if err := cl.SetLevel(module, strings.Join(spec, ",")); err != nil {
+		var cerr *client.Error
+		if errors.As(err, &cerr) && cerr.Status == protocol.StatusBadRequest {
+			return partialError(err, "Levels partly applied")
+		}
+		return moduleError(err)
+	}
+	return v2GetLevel(w, r)
+}
+
+// Enabled keys of a module
+type keysBody struct {
+	Keys []string `json:"keys"`
+}
+
+func enabledKeys(module string) (*keysBody, error) {
+	levels, err := cl.Levels(module)
+	if err != nil {
+		return nil, moduleError(err)
+	}
+	keys := &keysBody{Keys: make([]string, 0, len(levels.Keys))}
+	for key := range levels.Keys {
+		keys.Keys = append(keys.Keys, key)
+	}
+	sort.Strings(keys.Keys)
+	return keys, nil
+}
+
+func v2GetKeys(w http.ResponseWriter, r *http.Request) error {
+	keys, err := enabledKeys(mux.Vars(r)["module"])
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, keys)
+	return nil
+}
+
+// Replace the enabled keys. Keys already enabled keep their level
+func v2PutKeys(w http.ResponseWriter, r *http.Request) error {
+	module := mux.Vars(r)["module"]
+	req := keysBody{}
+	if err := decodeBody(w, r, &req); err != nil {
+		return err
+	}
+	if req.Keys == nil {
+		return newAPIError(http.StatusBadRequest, "Missing keys")
+	}
+	wanted := make(map[string]bool)
+	for _, key := range req.Keys {
+		if !validKey(key) {
+			return newAPIError(http.StatusBadRequest, "Invalid key %q", key)
+		}
+		wanted[key] = true
+	}
+
+	current, err := enabledKeys(module)
+	if err != nil {
+		return err
+	}
+	var disable []string
+	for _, key := range current.Keys {
+		if !wanted[key] {
+			disable = append(disable, key)
+		}
+	}
+	// enabling first, a failure leaves the module logging more keys rather
+	// than fewer
+	if len(req.Keys) > 0 {
+		if err = cl.EnableKeys(module, req.Keys); err != nil {
+			return moduleError(err)
+		}
+	}
+	if len(disable) > 0 {
+		if err = cl.DisableKeys(module, disable); err != nil {
+			return partialError(err, "Keys enabled but %s not disabled", strings.Join(disable, ","))
+		}
+	}
+	return v2GetKeys(w, r)
+}
+
+func v2Rotate(w http.ResponseWriter, r *http.Request) error {
+	if err := cl.Rotate(mux.Vars(r)["module"]); err != nil {
+		return moduleError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func v2PutTrace(w http.ResponseWriter, r *http.Request) error {
+	req := struct {
+		Enabled *bool `json:"enabled"`
+	}{}
+	if err := decodeBody(w, r, &req); err != nil {
+		return err
+	}
+	if req.Enabled == nil {
+		return newAPIError(http.StatusBadRequest, "Missing enabled")
+	}
+	if err := cl.EnableTrace(mux.Vars(r)["module"], *req.Enabled); err != nil {
+		return moduleError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func v2PutPath(w http.ResponseWriter, r *http.Request) error {
+	req := struct {
+		Path string `json:"path"`
+	}{}
+	if err := decodeBody(w, r, &req); err != nil {
+		return err
+	}
+	if req.Path == "" {
+		return newAPIError(http.StatusBadRequest, "Missing path")
+	}
+	if err := cl.SetPath(mux.Vars(r)["module"], req.Path); err != nil {
+		return moduleError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func v2Logs(w http.ResponseWriter, r *http.Request) error {
+	reader, err := cl.StreamLog(mux.Vars(r)["module"])
+	if err != nil {
+		return moduleError(err)
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, reader)
+	return nil
+}
+
+func v2Trace(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	paths, err := traceFiles(vars["module"], vars["traceId"])
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "%s", err.Error())
+	} else if len(paths) == 0 {
+		return newAPIError(http.StatusNotFound, "Trace log %s not found", vars["traceId"])
+	}
+	file, _, err := openFile(paths[0], os.Open)
+	if err != nil {
+		return newAPIError(fileErrorStatus(err), "%s", err.Error())
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, file)
+	return nil
+}
+
+func v2Stats(w http.ResponseWriter, r *http.Request) error {
+	stats, err := cl.GetStats(mux.Vars(r)["module"])
+	if err != nil {
+		return moduleError(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(stats)
+	return nil
+}
+
+func v2Alarms(w http.ResponseWriter, r *http.Request) error {
+	targets, err := cl.AlarmTargets(mux.Vars(r)["module"])
+	if err != nil {
+		return moduleError(err)
+	}
+	writeJSON(w, http.StatusOK, targets)
+	return nil
+}
+
+// Add an alarm target given as a logger.AlarmTargetInfo object, answering the
+// updated list. Location names the target added
+func v2AddAlarm(w http.ResponseWriter, r *http.Request) error {
+	module := mux.Vars(r)["module"]
+	var target map[string]json.RawMessage
+	if err := decodeBody(w, r, &target); err != nil {
+		return err
+	}
+	if target == nil {
+		return newAPIError(http.StatusBadRequest, "Alarm target must be an object")
+	}
+	data, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	if err = cl.SetAlarm(module, string(data)); err != nil {
+		return moduleError(err)
+	}
+	targets, err := cl.AlarmTargets(module)
+	if err != nil {
+		return moduleError(err)
+	}
+	info := logger.AlarmTargetInfo{}
+	json.Unmarshal(data, &info)
+	if info.Name == "" {
+		info.Name = logger.AlarmTargetName(info.Endpoint)
+	}
+	w.Header().Set("Location", API_V2+"/modules/"+url.PathEscape(module)+"/alarms/"+url.PathEscape(info.Name))
+	writeJSON(w, http.StatusCreated, targets)
+	return nil
+}
+
+func v2ClearAlarms(w http.ResponseWriter, r *http.Request) error {
+	if err := cl.ClearAlarm(mux.Vars(r)["module"], ""); err != nil {
+		return moduleError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func v2RemoveAlarm(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	if strings.TrimSpace(vars["name"]) == "" {
+		return newAPIError(http.StatusBadRequest, "Missing alarm name")
+	}
+	if err := cl.ClearAlarm(vars["module"], vars["name"]); err != nil {
+		return moduleError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func v2Files(w http.ResponseWriter, r *http.Request) error {
+	files, err := moduleFiles(r.URL.Query().Get("module"))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, files)
+	return nil
+}
@@ -0,0 +1,151 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/couchbase/retriever/logger"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIv2(t *testing.T) {
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+	defer func() {
+		rl.SetLogLevel(logger.LevelError)
+		rl.DisableKeys([]string{"Index", "DCP"})
+		rl.EnableKeys([]string{"Default"})
+	}()
+
+	request := func(method, path, body string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed ! %s", err.Error())
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+	const module = "/api/v2/modules/testretriever"
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"module", "GET", module, "", http.StatusOK},
+		{"unknown module", "GET", "/api/v2/modules/nosuch", "", http.StatusNotFound},
+		{"unknown module level", "GET", "/api/v2/modules/nosuch/level", "", http.StatusNotFound},
+		{"invalid level", "PUT", module + "/level", `{"level":"loud"}`, http.StatusBadRequest},
+		{"empty level", "PUT", module + "/level", `{}`, http.StatusBadRequest},
+		{"missing body", "PUT", module + "/level", "", http.StatusBadRequest},
+		{"truncated body", "PUT", module + "/level", `{"level":`, http.StatusBadRequest},
+		{"unknown field", "PUT", module + "/level", `{"lvl":"warn"}`, http.StatusBadRequest},
+		{"invalid key", "PUT", module + "/keys", `{"keys":["a=b"]}`, http.StatusBadRequest},
+		{"key with a space", "PUT", module + "/keys", `{"keys":["a b"]}`, http.StatusBadRequest},
+		{"invalid key level", "PUT", module + "/level", `{"keys":{"DCP":"loud"}}`, http.StatusBadRequest},
+		{"global module level", "PUT", module + "/level", `{"level":"global"}`, http.StatusBadRequest},
+		{"missing trace flag", "PUT", module + "/trace", `{}`, http.StatusBadRequest},
+		{"trace on", "PUT", module + "/trace", `{"enabled":true}`, http.StatusNoContent},
+		{"trace off", "PUT", module + "/trace", `{"enabled":false}`, http.StatusNoContent},
+		{"invalid trace id", "GET", module + "/traces/..", "", http.StatusBadRequest},
+		{"hidden trace id", "GET", module + "/traces/.hidden", "", http.StatusBadRequest},
+		{"unknown trace id", "GET", module + "/traces/nosuch", "", http.StatusNotFound},
+		{"rotate without a file", "POST", module + "/rotate", "", http.StatusBadGateway},
+		{"rotate with GET", "GET", module + "/rotate", "", http.StatusMethodNotAllowed},
+		{"no stats socket", "GET", module + "/stats", "", http.StatusNotFound},
+		{"unknown resource", "GET", "/api/v2/nosuch", "", http.StatusNotFound},
+		{"add alarm", "POST", module + "/alarms", `{"Name":"ops","Endpoint":"http://localhost:9111/alarm/"}`, http.StatusCreated},
+		{"invalid alarm", "POST", module + "/alarms", `["http://localhost:9111/alarm/"]`, http.StatusBadRequest},
+		{"remove alarm", "DELETE", module + "/alarms/ops", "", http.StatusNoContent},
+		{"remove unknown alarm", "DELETE", module + "/alarms/ops", "", http.StatusNotFound},
+		{"v1 unknown command", "POST", "/logger/testretriever", `{"Cmd":"bogus"}`, http.StatusBadRequest},
+		{"v1 unknown command for all", "POST", "/logger/all", `{"Cmd":"bogus"}`, http.StatusBadRequest},
+		{"v1 invalid body", "POST", "/logger/testretriever", `{"Cmd":`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp, data := request(test.method, test.path, test.body)
+		if resp.StatusCode != test.status {
+			t.Errorf("Failed ! %s: expected %d got %d %s", test.name, test.status, resp.StatusCode, data)
+			continue
+		}
+		if resp.StatusCode < 300 || !strings.HasPrefix(test.path, API_V2) {
+			continue
+		}
+		aerr := apiError{}
+		if err := json.Unmarshal(data, &aerr); err != nil || aerr.Status != test.status || aerr.Message == "" {
+			t.Errorf("Failed ! %s: unexpected error body %s", test.name, data)
+		}
+	}
+
+	// targets added without a name are named after the endpoint
+	resp, data := request("POST", module+"/alarms", `{"Endpoint":"http://localhost:9111/alarm/"}`)
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusCreated || location != module+"/alarms/"+logger.AlarmTargetName("http://localhost:9111/alarm/") {
+		t.Fatalf("Failed ! unexpected unnamed target %d %s %s", resp.StatusCode, location, data)
+	}
+	if resp, data = request("DELETE", location, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Failed ! unnamed target not removed %d %s", resp.StatusCode, data)
+	}
+
+	resp, _ = request("GET", module+"/rotate", "")
+	if resp.Header.Get("Allow") != "POST" {
+		t.Errorf("Failed ! expected Allow POST, got %q", resp.Header.Get("Allow"))
+	}
+
+	resp, data = request("PUT", module+"/level", `{"level":"warn","keys":{"DCP":"debug"}}`)
+	levels := logger.LevelSettings{}
+	if err := json.Unmarshal(data, &levels); err != nil || resp.StatusCode != http.StatusOK ||
+		levels.Level != "warn" || levels.Keys["DCP"] != "debug" {
+		t.Errorf("Failed ! unexpected levels %d %s", resp.StatusCode, data)
+	}
+	if rl.GetLogLevel() != logger.LevelWarn || rl.KeyLevels()["DCP"] != logger.LevelDebug {
+		t.Errorf("Failed ! levels not applied")
+	}
+
+	// nothing is applied when part of the request is invalid
+	resp, data = request("PUT", module+"/level", `{"level":"error","keys":{"A":"debug","DCP":"loud"}}`)
+	if resp.StatusCode != http.StatusBadRequest || rl.GetLogLevel() != logger.LevelWarn {
+		t.Errorf("Failed ! invalid levels partly applied %d %s", resp.StatusCode, data)
+	}
+	if _, found := rl.KeyLevels()["A"]; found {
+		t.Errorf("Failed ! key of invalid levels enabled")
+	}
+
+	// the listed keys replace the enabled ones
+	resp, data = request("PUT", module+"/keys", `{"keys":["Index","DCP"]}`)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(data)) != `{"keys":["DCP","Index"]}` {
+		t.Errorf("Failed ! unexpected keys %d %s", resp.StatusCode, data)
+	}
+	if keys := rl.KeyLevels(); len(keys) != 2 || keys["DCP"] != logger.LevelDebug {
+		t.Errorf("Failed ! keys not replaced %v", keys)
+	}
+
+	resp, data = request("GET", "/api/v2/openapi.json", "")
+	doc := struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(data, &doc); err != nil || resp.StatusCode != http.StatusOK || doc.OpenAPI == "" {
+		t.Fatalf("Failed ! invalid OpenAPI document %d %v", resp.StatusCode, err)
+	}
+	for _, path := range []string{"/modules/{module}/level", "/modules/{module}/rotate", "/modules/{module}/logs",
+		"/modules/{module}/keys", "/modules/{module}/stats"} {
+		if doc.Paths[path] == nil {
+			t.Errorf("Failed ! %s not documented", path)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Roles of authenticated callers. Readers may retrieve logs, trace logs,
+// stats and module lists, admins may also change the modules
+const (
+	ROLE_READ  = "read"
+	ROLE_ADMIN = "admin"
+)
+
+const PASSWORD_HASH_SCHEME = "pbkdf2-sha256"
+const PASSWORD_HASH_ITERATIONS = 600000
+const PASSWORD_SALT_SIZE = 16
+
+// Entry of the tokens file. Either the token or its SHA-256 in hex is given
+type TokenEntry struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Token  string `json:"token,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Entry of the credentials file. Password is a hash from -hash-password
+type CredentialEntry struct {
+	User     string `json:"user"`
+	Role     string `json:"role"`
+	Password string `json:"password"`
+}
+
+type principal struct {
+	Name string
+	Role string
+}
+
+type authenticator struct {
+	tokens   map[[sha256.Size]byte]principal // by token hash
+	users    map[string]CredentialEntry
+	mu       sync.Mutex                   // guards verified
+	verified map[string][sha256.Size]byte // hash of the last password verified by user
+}
+
+type principalKey struct{}
+
+func validRole(role string) bool {
+	return role == ROLE_READ || role == ROLE_ADMIN
+}
+
+// decode a JSON list rejecting unknown fields
+func readEntries(path string, entries interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(entries); err != nil {
+		return fmt.Errorf("Invalid %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// Load the tokens and credentials files. Returns nil when authentication is
+// not configured
+func loadAuth(cfg AuthConfig) (*authenticator, error) {
+	if cfg.TokensFile == "" && cfg.CredentialsFile == "" {
+		return nil, nil
+	}
+	a := &authenticator{
+		tokens:   make(map[[sha256.Size]byte]principal),
+		users:    make(map[string]CredentialEntry),
+		verified: make(map[string][sha256.Size]byte),
+	}
+
+	if cfg.TokensFile != "" {
+		var tokens []TokenEntry
+		if err := readEntries(cfg.TokensFile, &tokens); err != nil {
+			return nil, err
+		}
+		for i, t := range tokens {
+			if t.Name == "" || !validRole(t.Role) {
+				return nil, fmt.Errorf("Token %d: name and a role of %s or %s required", i, ROLE_READ, ROLE_ADMIN)
+			}
+			var sum [sha256.Size]byte
+			switch {
+			case t.Token != "" && t.SHA256 == "":
+				sum = sha256.Sum256([]byte(t.Token))
+			case t.Token == "" && t.SHA256 != "":
+				raw, err := hex.DecodeString(t.SHA256)
+				if err != nil || len(raw) != sha256.Size {
+					return nil, fmt.Errorf("Token %s: invalid sha256", t.Name)
+				}
+				copy(sum[:], raw)
+			default:
+				return nil, fmt.Errorf("Token %s: one of token or sha256 required", t.Name)
+			}
+			a.tokens[sum] = principal{Name: t.Name, Role: t.Role}
+		}
+	}
+
+	if cfg.CredentialsFile != "" {
+		var users []CredentialEntry
+		if err := readEntries(cfg.CredentialsFile, &users); err != nil {
+			return nil, err
+		}
+		for i, u := range users {
+			if u.User == "" || !validRole(u.Role) {
+				return nil, fmt.Errorf("User %d: user and a role of %s or %s required", i, ROLE_READ, ROLE_ADMIN)
+			}
+			if _, _, _, err := parsePasswordHash(u.Password); err != nil {
+				return nil, fmt.Errorf("User %s: %s", u.User, err.Error())
+			}
+			a.users[u.User] = u
+		}
+	}
+	return a, nil
+}
+
+// Hash a password for the credentials file
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, PASSWORD_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, PASSWORD_HASH_ITERATIONS, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", PASSWORD_HASH_SCHEME, PASSWORD_HASH_ITERATIONS,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// split a password hash into iterations, salt and key
+func parsePasswordHash(hash string) (int, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != PASSWORD_HASH_SCHEME {
+		return 0, nil, nil, fmt.Errorf("Password is not a %s hash", PASSWORD_HASH_SCHEME)
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return 0, nil, nil, fmt.Errorf("Invalid password hash iterations")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("Invalid password hash salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("Invalid password hash")
+	}
+	return iter, salt, key, nil
+}
+
+func checkPassword(hash string, password string) bool {
+	iter, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	derived, err := pbkdf2.Key(sha256.New, password, salt, iter, len(key))
+	return err == nil && subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// identify the caller of a request from its bearer token, basic credentials
+// or else verified client certificate
+func (a *authenticator) authenticate(r *http.Request) (principal, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		role := config().TLS.ClientRole
+		if role != "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			return principal{Name: r.TLS.VerifiedChains[0][0].Subject.CommonName, Role: role}, true
+		}
+		return principal{}, false
+	}
+	// the scheme is case-insensitive
+	if scheme, token, ok := strings.Cut(header, " "); ok && strings.EqualFold(scheme, "Bearer") {
+		p, found := a.tokens[sha256.Sum256([]byte(strings.TrimSpace(token)))]
+		return p, found
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		u, found := a.users[user]
+		if !found {
+			// check a password anyway so unknown users take as long
+			checkPassword(dummyHash(), password)
+			return principal{}, false
+		}
+
+		// password hashing is slow, remember the last password verified
+		sum := sha256.Sum256([]byte(password))
+		a.mu.Lock()
+		last, seen := a.verified[user]
+		a.mu.Unlock()
+		if seen && subtle.ConstantTimeCompare(last[:], sum[:]) == 1 {
+			return principal{Name: u.User, Role: u.Role}, true
+		}
+		if checkPassword(u.Password, password) {
+			a.mu.Lock()
+			a.verified[user] = sum
+			a.mu.Unlock()
+			return principal{Name: u.User, Role: u.Role}, true
+		}
+	}
+	return principal{}, false
+}
+
+// hash checked for unknown users
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword("")
+	return hash
+})
+
+// Authenticate every request when auth is configured, answering 401 to
+// callers without valid credentials
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := config().authenticator
+		if a == nil {
+			// authentication disabled
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{},
+				principal{Role: ROLE_ADMIN})))
+			return
+		}
+		p, ok := a.authenticate(r)
+		if !ok {
+			rl.LogWarn("", LOGGER, "Unauthenticated request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Add("WWW-Authenticate", `Bearer realm="retriever"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="retriever"`)
+			if isAPIv2(r) {
+				writeError(w, newAPIError(http.StatusUnauthorized, "Unauthorized"))
+			} else {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// Check that the caller may run an operation, answering 403 if not. Mutating
+// operations require the admin role
+func authorize(w http.ResponseWriter, r *http.Request, mutating bool) bool {
+	if !allowed(r, mutating) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// check the role of the caller, logging refusals
+func allowed(r *http.Request, mutating bool) bool {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	if p.Role == ROLE_ADMIN || (p.Role == ROLE_READ && !mutating) {
+		return true
+	}
+	rl.LogWarn("", LOGGER, "Forbidden request %s %s by %s", r.Method, r.URL.Path, p.Name)
+	return false
+}
+
+// logger commands that only read from the modules
+var readCommands = map[string]bool{
+	"log":       true,
+	"traceLog":  true,
+	"file":      true,
+	"alarmList": true,
+	"loglist":   true,
+}
+
+// Check whether a logger command changes a module. Unknown commands are
+// treated as mutating
+func mutatingCommand(cmd string) bool {
+	return !readCommands[cmd]
+}
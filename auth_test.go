@@ -0,0 +1,109 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	hash, err := hashPassword("s3cret")
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	if !checkPassword(hash, "s3cret") || checkPassword(hash, "secret") {
+		t.Errorf("Failed ! password check")
+	}
+
+	sum := sha256.Sum256([]byte("admin-token"))
+	cfg := defaultConfig()
+	cfg.RuntimeDir = testDir
+	cfg.Auth.TokensFile = writeConfig(t, `[{"name": "ci", "role": "read", "token": "read-token"},
+		{"name": "ops", "role": "admin", "sha256": "`+hex.EncodeToString(sum[:])+`"}]`)
+	cfg.Auth.CredentialsFile = writeConfig(t, fmt.Sprintf(`[{"user": "alice", "role": "read", "password": %q}]`, hash))
+	if cfg.authenticator, err = loadAuth(cfg.Auth); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	setConfig(t, cfg)
+
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	request := func(method, path, body string, auth func(*http.Request)) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed ! %s", err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+	basic := func(user, password string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, password) }
+	}
+	level := `{"Cmd":"level", "Message":"debug"}`
+	stats := `{"Cmd":"stats"}`
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		auth   func(*http.Request)
+		status int
+	}{
+		{"no credentials", "GET", "/modules", "", nil, http.StatusUnauthorized},
+		{"unknown token", "GET", "/modules", "", bearer("nope"), http.StatusUnauthorized},
+		{"wrong password", "GET", "/modules", "", basic("alice", "secret"), http.StatusUnauthorized},
+		{"unknown user", "GET", "/modules", "", basic("bob", "s3cret"), http.StatusUnauthorized},
+		{"reader lists modules", "GET", "/modules", "", bearer("read-token"), http.StatusOK},
+		{"lowercase scheme", "GET", "/modules", "", func(req *http.Request) {
+			req.Header.Set("Authorization", "bearer read-token")
+		}, http.StatusOK},
+		{"uppercase scheme", "GET", "/modules", "", func(req *http.Request) {
+			req.Header.Set("Authorization", "BEARER read-token")
+		}, http.StatusOK},
+		{"basic reader lists modules", "GET", "/modules", "", basic("alice", "s3cret"), http.StatusOK},
+		{"basic reader again", "GET", "/modules", "", basic("alice", "s3cret"), http.StatusOK},
+		{"reader sets level", "POST", "/logger/testretriever", level, bearer("read-token"), http.StatusForbidden},
+		{"basic reader sets level", "POST", "/logger/testretriever", level, basic("alice", "s3cret"), http.StatusForbidden},
+		{"reader rotates all", "POST", "/logger/all", `{"Cmd":"rotate"}`, bearer("read-token"), http.StatusForbidden},
+		{"reader unknown command", "POST", "/logger/all", `{"Cmd":"bogus"}`, bearer("read-token"), http.StatusForbidden},
+		{"reader reads stats", "POST", "/stats/all", stats, bearer("read-token"), http.StatusOK},
+		{"admin sets level", "POST", "/logger/testretriever", level, bearer("admin-token"), http.StatusOK},
+		{"v2 no credentials", "GET", "/api/v2/modules", "", nil, http.StatusUnauthorized},
+		{"v2 reader gets level", "GET", "/api/v2/modules/testretriever/level", "", bearer("read-token"), http.StatusOK},
+		{"v2 reader sets level", "PUT", "/api/v2/modules/testretriever/level", `{"level":"debug"}`, bearer("read-token"), http.StatusForbidden},
+		{"v2 admin sets level", "PUT", "/api/v2/modules/testretriever/level", `{"level":"error"}`, bearer("admin-token"), http.StatusOK},
+	}
+	for _, test := range tests {
+		if status := request(test.method, test.path, test.body, test.auth); status != test.status {
+			t.Errorf("Failed ! %s: expected %d got %d", test.name, test.status, status)
+		}
+	}
+
+	if _, err = loadAuth(AuthConfig{TokensFile: writeConfig(t, `[{"name": "x", "role": "root", "token": "t"}]`)}); err == nil {
+		t.Errorf("Failed ! expected invalid role")
+	}
+	if _, err = loadAuth(AuthConfig{CredentialsFile: writeConfig(t, `[{"user": "x", "role": "read", "password": "plain"}]`)}); err == nil {
+		t.Errorf("Failed ! expected invalid password hash")
+	}
+}
@@ -0,0 +1,300 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+// Package client controls modules using the logger and stats packages through
+// their control sockets (named pipes on Windows)
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbase/retriever/logger"
+	"github.com/couchbase/retriever/protocol"
+	"github.com/couchbase/retriever/registry"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+// Control sockets of a module
+const (
+	LogSocket   = "log"
+	StatsSocket = "stats"
+)
+
+// returned when the socket of a module cannot be reached
+var ErrModuleNotFound = errors.New("Module not found")
+
+// wrapped by the errors of requests not answered in time
+var ErrTimeout = errors.New("no response in time")
+
+// A request rejected by a module
+type Error struct {
+	Module  string
+	Status  int // protocol status code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Module %s: %s", e.Module, e.Message)
+}
+
+type Client struct {
+	Dir      string        // runtime directory of the modules
+	Timeout  time.Duration // timeout of a request, not including streamed content
+	Deadline time.Time     // when set, requests end by then whatever the timeout
+}
+
+// Create a client for the modules of the default runtime directory
+func NewClient() *Client {
+	return &Client{Dir: registry.DefaultRuntimeDir(), Timeout: DEFAULT_TIMEOUT}
+}
+
+// Return the descriptors of the running modules in the registry
+func (cl *Client) Registered() ([]registry.Descriptor, error) {
+	return registry.List(registry.Dir(cl.Dir))
+}
+
+// Return the registry descriptor of a running module
+func (cl *Client) Lookup(module string) (*registry.Descriptor, error) {
+	d, err := registry.Lookup(registry.Dir(cl.Dir), module)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %s", ErrModuleNotFound, module, err.Error())
+	}
+	return d, nil
+}
+
+// Return the names of the modules with a socket of the given kind. Sockets of
+// modules predating the registry are found by name
+func (cl *Client) Modules(socket string) ([]string, error) {
+	descriptors, err := cl.Registered()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	modules := make([]string, 0, len(descriptors))
+	for _, d := range descriptors {
+		if d.Sockets[socket] != "" {
+			found[d.Name] = true
+			modules = append(modules, d.Name)
+		}
+	}
+
+	prefix := socket + "_"
+	fileList, err := filepath.Glob(filepath.Join(cl.Dir, prefix+"*.sock"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fileName := range fileList {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(fileName), prefix), ".sock")
+		if !found[name] {
+			modules = append(modules, name)
+		}
+	}
+	sort.Strings(modules)
+	return modules, nil
+}
+
+// deadline of a request starting now, zero if none
+func (cl *Client) deadline() time.Time {
+	deadline := cl.Deadline
+	if cl.Timeout > 0 {
+		if t := time.Now().Add(cl.Timeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	return deadline
+}
+
+// error of a request to a module, wrapping ErrTimeout when it timed out
+func moduleErr(module string, err error) error {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return fmt.Errorf("Module %s: %w: %s", module, ErrTimeout, err.Error())
+	}
+	return fmt.Errorf("Module %s: %s", module, err.Error())
+}
+
+// connect to a socket of a module, with the deadline of the request set
+func (cl *Client) connect(socket string, module string) (net.Conn, error) {
+	if module == "" || strings.ContainsAny(module, `/\`) {
+		return nil, fmt.Errorf("Invalid module name %q", module)
+	}
+	deadline := cl.deadline()
+	var timeout time.Duration
+	if !deadline.IsZero() {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return nil, fmt.Errorf("Module %s: %w", module, ErrTimeout)
+		}
+	}
+	path := defaultSocket(cl.Dir, socket+"_"+module)
+	if d, err := registry.Lookup(registry.Dir(cl.Dir), module); err == nil && d.Sockets[socket] != "" {
+		path = d.Sockets[socket]
+	}
+	c, err := dial(path, timeout)
+	if err != nil {
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return nil, moduleErr(module, err)
+		}
+		return nil, fmt.Errorf("%w %s: %s", ErrModuleNotFound, module, err.Error())
+	}
+	c.SetDeadline(deadline)
+	return c, nil
+}
+
+// Send a request to a socket of a module. Failed requests are returned as *Error
+func (cl *Client) Call(socket string, module string, req *protocol.Request) (*protocol.Response, error) {
+	c, err := cl.connect(socket, module)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	resp, err := protocol.Call(c, req)
+	if err != nil {
+		return nil, moduleErr(module, err)
+	}
+	if resp.Status != protocol.StatusOK {
+		return nil, &Error{Module: module, Status: resp.Status, Message: resp.Err().Error()}
+	}
+	if resp.Body != nil {
+		// read the content before the connection is closed
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, moduleErr(module, err)
+		}
+		resp.Data, resp.Body = data, nil
+	}
+	return resp, nil
+}
+
+// send a log command expecting no data back
+func (cl *Client) logCommand(module string, command string, args ...string) error {
+	_, err := cl.Call(LogSocket, module, protocol.NewRequest(command, args...))
+	return err
+}
+
+// Set the log level and/or key levels e.g. "warn" or "info,DCP=debug"
+func (cl *Client) SetLevel(module string, level string) error {
+	return cl.logCommand(module, "level", level)
+}
+
+// Return the log level and the enabled keys with their level
+func (cl *Client) Levels(module string) (*logger.LevelSettings, error) {
+	resp, err := cl.Call(LogSocket, module, protocol.NewRequest("levels"))
+	if err != nil {
+		return nil, err
+	}
+	info := &logger.LevelSettings{}
+	if err = json.Unmarshal(resp.Data, info); err != nil {
+		return nil, fmt.Errorf("Module %s: %s", module, err.Error())
+	}
+	return info, nil
+}
+
+// Enable logging of keys at the global level
+func (cl *Client) EnableKeys(module string, keys []string) error {
+	return cl.logCommand(module, "keys", strings.Join(keys, ","))
+}
+
+func (cl *Client) DisableKeys(module string, keys []string) error {
+	return cl.logCommand(module, "keysoff", strings.Join(keys, ","))
+}
+
+// Rotate the log file
+func (cl *Client) Rotate(module string) error {
+	return cl.logCommand(module, "rotate")
+}
+
+// Enable or disable trace logging
+func (cl *Client) EnableTrace(module string, enable bool) error {
+	if enable {
+		return cl.logCommand(module, "trace")
+	}
+	return cl.logCommand(module, "traceoff")
+}
+
+// Add an alarm target, either an endpoint URL or a logger.AlarmTargetInfo
+// JSON object
+func (cl *Client) SetAlarm(module string, target string) error {
+	return cl.logCommand(module, "alarm", target)
+}
+
+// Remove the named alarm target, or all targets if name is empty
+func (cl *Client) ClearAlarm(module string, name string) error {
+	return cl.logCommand(module, "alarmoff", name)
+}
+
+// List the alarm targets
+func (cl *Client) AlarmTargets(module string) ([]logger.AlarmTargetInfo, error) {
+	resp, err := cl.Call(LogSocket, module, protocol.NewRequest("alarmlist"))
+	if err != nil {
+		return nil, err
+	}
+	var targets []logger.AlarmTargetInfo
+	if err = json.Unmarshal(resp.Data, &targets); err != nil {
+		return nil, fmt.Errorf("Module %s: %s", module, err.Error())
+	}
+	return targets, nil
+}
+
+// Change the default logging path
+func (cl *Client) SetPath(module string, path string) error {
+	return cl.logCommand(module, "setpath", path)
+}
+
+// Return the stats of a module as JSON
+func (cl *Client) GetStats(module string) (json.RawMessage, error) {
+	resp, err := cl.Call(StatsSocket, module, protocol.NewRequest("stats"))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// Stream the log file of a module. The caller must close the reader
+func (cl *Client) StreamLog(module string) (io.ReadCloser, error) {
+	c, err := cl.connect(LogSocket, module)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := protocol.Call(c, protocol.NewRequest("filelog"))
+	if err != nil {
+		c.Close()
+		return nil, moduleErr(module, err)
+	}
+	if resp.Status != protocol.StatusOK {
+		c.Close()
+		return nil, &Error{Module: module, Status: resp.Status, Message: resp.Err().Error()}
+	}
+	if !resp.Stream {
+		c.Close()
+		return nil, fmt.Errorf("Module %s: log not streamed", module)
+	}
+
+	// the log may take longer than a request
+	c.SetDeadline(time.Time{})
+	return &streamReader{Reader: resp.Body, c: c}, nil
+}
+
+type streamReader struct {
+	io.Reader
+	c net.Conn
+}
+
+func (sr *streamReader) Close() error {
+	return sr.c.Close()
+}
@@ -0,0 +1,179 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/couchbase/retriever/logger"
+	"github.com/couchbase/retriever/protocol"
+	"github.com/couchbase/retriever/registry"
+	"github.com/couchbase/retriever/stats"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wait for the socket of a module to be registered and listening
+func waitModule(t *testing.T, cl *Client, socket string, module string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		d, err := registry.Lookup(registry.Dir(cl.Dir), module)
+		if err == nil && d.Sockets[socket] != "" {
+			if c, err := cl.connect(socket, module); err == nil {
+				c.Close()
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Failed ! %s socket of %s not listening", socket, module)
+}
+
+func TestClient(t *testing.T) {
+
+	mylog, err := logger.NewLogger("testclient", logger.LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	mylog.SetDefaultPath(t.TempDir())
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	sc, err := stats.NewStatsCollector("testclient")
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	sc.AddStatKey("Connections", 4)
+
+	cl := NewClient()
+	waitModule(t, cl, LogSocket, "testclient")
+	waitModule(t, cl, StatsSocket, "testclient")
+
+	if modules, err := cl.Modules(LogSocket); err != nil || !strings.Contains(strings.Join(modules, ","), "testclient") {
+		t.Errorf("Failed ! module not discovered %v %v", modules, err)
+	}
+	descriptors, err := cl.Registered()
+	found := false
+	for _, d := range descriptors {
+		if d.Name == "testclient" {
+			found = d.Pid == os.Getpid() && d.Version == protocol.VERSION &&
+				len(d.Capabilities[LogSocket]) > 0 && len(d.Capabilities[StatsSocket]) > 0
+		}
+	}
+	if err != nil || !found {
+		t.Errorf("Failed ! module not registered %+v %v", descriptors, err)
+	}
+
+	if err = cl.SetLevel("testclient", "warn,DCP=debug"); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+	if mylog.GetLogLevel() != logger.LevelWarn {
+		t.Errorf("Failed ! level not set")
+	}
+	var cerr *Error
+	if err = cl.SetLevel("testclient", "loud"); !errors.As(err, &cerr) || cerr.Status != 400 {
+		t.Errorf("Failed ! expected bad request, got %v", err)
+	}
+	if err = cl.EnableKeys("testclient", []string{"Index", "Query"}); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+	if levels := mylog.KeyLevels(); levels["Index"] != logger.LevelGlobal || levels["DCP"] != logger.LevelDebug {
+		t.Errorf("Failed ! unexpected keys %v", levels)
+	}
+	if levels, err := cl.Levels("testclient"); err != nil || levels.Level != "warn" ||
+		levels.Keys["Index"] != "global" || levels.Keys["DCP"] != "debug" {
+		t.Errorf("Failed ! unexpected levels %+v %v", levels, err)
+	}
+	if err = cl.EnableTrace("testclient", true); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+	if err = cl.EnableTrace("testclient", false); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+
+	if err = cl.SetAlarm("testclient", "http://localhost:9111/alarm/"); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+	if targets, err := cl.AlarmTargets("testclient"); err != nil || len(targets) != 1 {
+		t.Errorf("Failed ! unexpected targets %v %v", targets, err)
+	}
+	if err = cl.ClearAlarm("testclient", ""); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+
+	mylog.LogWarn("", "Index", "streamed line")
+	reader, err := cl.StreamLog("testclient")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if !strings.Contains(string(data), "streamed line") {
+		t.Errorf("Failed ! log not streamed %s", string(data))
+	}
+	if err = cl.Rotate("testclient"); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+
+	raw, err := cl.GetStats("testclient")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	var all struct{ Stats map[string]interface{} }
+	if err = json.Unmarshal(raw, &all); err != nil || all.Stats["Connections"] != float64(4) {
+		t.Errorf("Failed ! unexpected stats %s", string(raw))
+	}
+
+	if err = cl.Rotate("nosuchmodule"); !errors.Is(err, ErrModuleNotFound) {
+		t.Errorf("Failed ! expected module not found, got %v", err)
+	}
+	if err = cl.Rotate("../x"); err == nil {
+		t.Errorf("Failed ! expected invalid module name")
+	}
+	mylog.Close()
+}
+
+func TestClientDeadline(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("module sockets are named pipes")
+	}
+	cl := &Client{Dir: t.TempDir(), Timeout: time.Minute}
+	l, err := net.Listen("unix", defaultSocket(cl.Dir, LogSocket+"_hung"))
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	defer l.Close()
+	// accept requests and never answer them
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	cl.Deadline = time.Now().Add(100 * time.Millisecond)
+	start := time.Now()
+	if err = cl.Rotate("hung"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Failed ! expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Failed ! request outlived the deadline, took %s", elapsed)
+	}
+	if err = cl.Rotate("hung"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Failed ! expected a timeout past the deadline, got %v", err)
+	}
+}
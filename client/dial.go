@@ -0,0 +1,26 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+// +build !windows
+
+package client
+
+import (
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// socket of modules not in the registry
+func defaultSocket(dir string, name string) string {
+	return filepath.Join(dir, name+".sock")
+}
+
+func dial(path string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", path, timeout)
+}
@@ -0,0 +1,31 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package client
+
+import (
+	"github.com/couchbase/retriever/registry"
+	"github.com/natefinch/npipe"
+	"net"
+	"time"
+)
+
+const DEFAULT_PIPE_PATH = registry.PIPE_PATH
+
+// pipe of modules not in the registry, registry.PipeName(dir, name) on Windows
+func defaultSocket(dir string, name string) string {
+	return registry.PipeName(dir, name)
+}
+
+func dial(path string, timeout time.Duration) (net.Conn, error) {
+	c, err := npipe.DialTimeout(path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
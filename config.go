@@ -0,0 +1,389 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/couchbase/retriever/client"
+	"github.com/couchbase/retriever/logger"
+	"github.com/couchbase/retriever/registry"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_LISTEN = ":8080"
+const DEFAULT_READ_HEADER_TIMEOUT = 10 * time.Second
+const DEFAULT_READ_TIMEOUT = 30 * time.Second
+const DEFAULT_IDLE_TIMEOUT = 2 * time.Minute
+const DEFAULT_MAX_MODULE_TIMEOUT = time.Minute
+
+// A duration written as a string in the config file e.g. "30s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("Invalid duration %s, expected a string like \"30s\"", string(data))
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type TLSConfig struct {
+	CertFile     string `json:"certFile,omitempty"`     // PEM certificate chain, enables TLS
+	KeyFile      string `json:"keyFile,omitempty"`      // PEM private key
+	ClientCAFile string `json:"clientCAFile,omitempty"` // CA bundle verifying client certificates
+	ClientAuth   string `json:"clientAuth,omitempty"`   // require (default) or optional client certificates
+	ClientRole   string `json:"clientRole,omitempty"`   // role of callers with a verified certificate, none if empty
+}
+
+type AuthConfig struct {
+	TokensFile      string `json:"tokensFile,omitempty"`      // bearer tokens and their roles
+	CredentialsFile string `json:"credentialsFile,omitempty"` // basic auth users and their roles
+}
+
+type TimeoutConfig struct {
+	ReadHeader Duration `json:"readHeader,omitempty"` // reading request headers
+	Read       Duration `json:"read,omitempty"`       // reading a whole request
+	Write      Duration `json:"write,omitempty"`      // writing a response, none by default as logs are streamed
+	Idle       Duration `json:"idle,omitempty"`       // keep-alive connections
+	Module     Duration `json:"module,omitempty"`     // requests to module sockets
+	MaxModule  Duration `json:"maxModule,omitempty"`  // largest ?timeout= of commands for all modules
+}
+
+// Configuration of the retriever server. Listen, RuntimeDir, LogModule and
+// Timeouts are read at startup, the other settings are reloaded on SIGHUP
+type Config struct {
+	Listen         string        `json:"listen,omitempty"`
+	RuntimeDir     string        `json:"runtimeDir,omitempty"`
+	LogModule      string        `json:"logModule,omitempty"` // module name of the server logger
+	LogLevel       string        `json:"logLevel,omitempty"`
+	LogKeys        []string      `json:"logKeys,omitempty"`
+	TLS            TLSConfig     `json:"tls,omitzero"`
+	Auth           AuthConfig    `json:"auth,omitzero"`
+	FileRoots      []string      `json:"fileRoots,omitempty"`      // directories files may be read from
+	AllowedOrigins []string      `json:"allowedOrigins,omitempty"` // web origins of other hosts allowed to open WebSockets
+	Timeouts       TimeoutConfig `json:"timeouts,omitzero"`
+
+	authenticator *authenticator // loaded from Auth, nil if disabled
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:     DEFAULT_LISTEN,
+		RuntimeDir: registry.DefaultRuntimeDir(),
+		LogModule:  DEFAULT,
+		LogLevel:   "debug",
+		LogKeys:    []string{DEFAULT, LOGGER, "Stats"},
+		Timeouts: TimeoutConfig{
+			ReadHeader: Duration(DEFAULT_READ_HEADER_TIMEOUT),
+			Read:       Duration(DEFAULT_READ_TIMEOUT),
+			Idle:       Duration(DEFAULT_IDLE_TIMEOUT),
+			Module:     Duration(client.DEFAULT_TIMEOUT),
+			MaxModule:  Duration(DEFAULT_MAX_MODULE_TIMEOUT),
+		},
+	}
+}
+
+// current configuration, replaced on reload
+var currentConfig atomic.Pointer[Config]
+
+func config() *Config {
+	return currentConfig.Load()
+}
+
+// repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type cmdLine struct {
+	configFile   string
+	apply        func(*Config) // applies the flags given over a configuration
+	hashPassword bool          // print the hash of a password read from stdin
+}
+
+// Parse the command line
+func parseFlags(args []string) (*cmdLine, error) {
+	fs := flag.NewFlagSet("retriever", flag.ContinueOnError)
+	flags := defaultConfig()
+	var roots stringList
+	var origins stringList
+	var keys string
+	var timeout time.Duration
+
+	configFile := fs.String("config", "", "JSON configuration file")
+	hashPassword := fs.Bool("hash-password", false, "print the credentials file hash of a password read from stdin")
+	fs.StringVar(&flags.Listen, "listen", flags.Listen, "listen address host:port")
+	fs.StringVar(&flags.RuntimeDir, "runtime-dir", flags.RuntimeDir, "runtime directory of the modules")
+	fs.StringVar(&flags.LogModule, "log-module", flags.LogModule, "module name of the server logger")
+	fs.StringVar(&flags.LogLevel, "log-level", flags.LogLevel, "log level of the server logger")
+	fs.StringVar(&keys, "log-keys", strings.Join(flags.LogKeys, ","), "log keys of the server logger")
+	fs.StringVar(&flags.TLS.CertFile, "tls-cert", "", "TLS certificate file")
+	fs.StringVar(&flags.TLS.KeyFile, "tls-key", "", "TLS private key file")
+	fs.StringVar(&flags.TLS.ClientCAFile, "tls-client-ca", "", "CA bundle verifying client certificates")
+	fs.StringVar(&flags.TLS.ClientAuth, "tls-client-auth", "", "client certificates require or optional")
+	fs.StringVar(&flags.TLS.ClientRole, "tls-client-role", "", "role of callers with a verified client certificate")
+	fs.StringVar(&flags.Auth.TokensFile, "auth-tokens", "", "bearer tokens file")
+	fs.StringVar(&flags.Auth.CredentialsFile, "auth-credentials", "", "basic auth credentials file")
+	fs.Var(&roots, "file-root", "directory files may be read from, repeatable")
+	fs.Var(&origins, "allowed-origin", "web origin allowed to open WebSockets, repeatable")
+	fs.DurationVar(&timeout, "module-timeout", time.Duration(flags.Timeouts.Module), "timeout of module requests")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments %v", fs.Args())
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	apply := func(cfg *Config) {
+		for name := range set {
+			switch name {
+			case "listen":
+				cfg.Listen = flags.Listen
+			case "runtime-dir":
+				cfg.RuntimeDir = flags.RuntimeDir
+			case "log-module":
+				cfg.LogModule = flags.LogModule
+			case "log-level":
+				cfg.LogLevel = flags.LogLevel
+			case "log-keys":
+				cfg.LogKeys = splitList(keys)
+			case "tls-cert":
+				cfg.TLS.CertFile = flags.TLS.CertFile
+			case "tls-key":
+				cfg.TLS.KeyFile = flags.TLS.KeyFile
+			case "tls-client-ca":
+				cfg.TLS.ClientCAFile = flags.TLS.ClientCAFile
+			case "tls-client-auth":
+				cfg.TLS.ClientAuth = flags.TLS.ClientAuth
+			case "tls-client-role":
+				cfg.TLS.ClientRole = flags.TLS.ClientRole
+			case "auth-tokens":
+				cfg.Auth.TokensFile = flags.Auth.TokensFile
+			case "auth-credentials":
+				cfg.Auth.CredentialsFile = flags.Auth.CredentialsFile
+			case "file-root":
+				cfg.FileRoots = append([]string(nil), roots...)
+			case "allowed-origin":
+				cfg.AllowedOrigins = append([]string(nil), origins...)
+			case "module-timeout":
+				cfg.Timeouts.Module = Duration(timeout)
+			}
+		}
+	}
+	return &cmdLine{configFile: *configFile, apply: apply, hashPassword: *hashPassword}, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Build the configuration from the defaults, the config file if any and the
+// command line flags, and validate it
+func loadConfig(path string, apply func(*Config)) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read config %s", err.Error())
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("Invalid config %s: %s", path, err.Error())
+		}
+	}
+	if apply != nil {
+		apply(cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	var err error
+	if cfg.authenticator, err = loadAuth(cfg.Auth); err != nil {
+		return nil, fmt.Errorf("auth: %s", err.Error())
+	}
+	return cfg, nil
+}
+
+func checkFile(name string, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err.Error())
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: %s is a directory", name, path)
+	}
+	return nil
+}
+
+// Check the configuration, reporting every invalid setting
+func (cfg *Config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %s", err.Error()))
+	}
+	if cfg.RuntimeDir == "" {
+		errs = append(errs, fmt.Errorf("runtimeDir: required"))
+	} else if fi, err := os.Stat(cfg.RuntimeDir); err != nil {
+		errs = append(errs, fmt.Errorf("runtimeDir: %s", err.Error()))
+	} else if !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("runtimeDir: %s is not a directory", cfg.RuntimeDir))
+	}
+	if cfg.LogModule == "" {
+		errs = append(errs, fmt.Errorf("logModule: required"))
+	}
+	if level, err := logger.ParseLogLevel(cfg.LogLevel); err != nil || level == logger.LevelGlobal {
+		errs = append(errs, fmt.Errorf("logLevel: invalid level %q", cfg.LogLevel))
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("tls: certFile and keyFile must be set together"))
+	}
+	if cfg.TLS.ClientCAFile != "" && cfg.TLS.CertFile == "" {
+		errs = append(errs, fmt.Errorf("tls: clientCAFile requires certFile and keyFile"))
+	}
+	if cfg.TLS.ClientAuth != "" && cfg.TLS.ClientAuth != CLIENT_AUTH_REQUIRE && cfg.TLS.ClientAuth != CLIENT_AUTH_OPTIONAL {
+		errs = append(errs, fmt.Errorf("tls: clientAuth must be %s or %s", CLIENT_AUTH_REQUIRE, CLIENT_AUTH_OPTIONAL))
+	}
+	if cfg.TLS.ClientRole != "" && !validRole(cfg.TLS.ClientRole) {
+		errs = append(errs, fmt.Errorf("tls: clientRole must be %s or %s", ROLE_READ, ROLE_ADMIN))
+	}
+	if (cfg.TLS.ClientAuth != "" || cfg.TLS.ClientRole != "") && cfg.TLS.ClientCAFile == "" {
+		errs = append(errs, fmt.Errorf("tls: clientAuth and clientRole require clientCAFile"))
+	}
+	// without auth every caller is an admin and certificates grant nothing
+	if cfg.TLS.ClientRole != "" && cfg.Auth.TokensFile == "" && cfg.Auth.CredentialsFile == "" {
+		errs = append(errs, fmt.Errorf("tls: clientRole requires auth.tokensFile or auth.credentialsFile"))
+	}
+	files := []struct{ name, path string }{
+		{"tls.certFile", cfg.TLS.CertFile},
+		{"tls.keyFile", cfg.TLS.KeyFile},
+		{"tls.clientCAFile", cfg.TLS.ClientCAFile},
+		{"auth.tokensFile", cfg.Auth.TokensFile},
+		{"auth.credentialsFile", cfg.Auth.CredentialsFile},
+	}
+	for _, f := range files {
+		if f.path != "" {
+			if err := checkFile(f.name, f.path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for _, root := range cfg.FileRoots {
+		if !filepath.IsAbs(root) {
+			errs = append(errs, fmt.Errorf("fileRoots: %s is not an absolute path", root))
+		} else if fi, err := os.Stat(root); err != nil {
+			errs = append(errs, fmt.Errorf("fileRoots: %s", err.Error()))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("fileRoots: %s is not a directory", root))
+		}
+	}
+
+	for _, origin := range cfg.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+			errs = append(errs, fmt.Errorf("allowedOrigins: %s is not an origin such as https://host:port", origin))
+		}
+	}
+
+	timeouts := []struct {
+		name string
+		d    Duration
+	}{
+		{"timeouts.readHeader", cfg.Timeouts.ReadHeader},
+		{"timeouts.read", cfg.Timeouts.Read},
+		{"timeouts.write", cfg.Timeouts.Write},
+		{"timeouts.idle", cfg.Timeouts.Idle},
+		{"timeouts.module", cfg.Timeouts.Module},
+		{"timeouts.maxModule", cfg.Timeouts.MaxModule},
+	}
+	for _, t := range timeouts {
+		if t.d < 0 {
+			errs = append(errs, fmt.Errorf("%s: negative duration", t.name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// apply the reloadable settings of a new configuration. Settings read at
+// startup are kept, with a warning if they changed
+func reloadConfig(cfg *Config) {
+	old := config()
+	if (cfg.TLS.CertFile == "") != (old.TLS.CertFile == "") {
+		rl.LogWarn("", DEFAULT, "Enabling or disabling TLS requires a restart")
+		cfg.TLS = old.TLS
+	}
+	if cfg.Listen != old.Listen || cfg.RuntimeDir != old.RuntimeDir || cfg.LogModule != old.LogModule ||
+		cfg.Timeouts != old.Timeouts {
+		rl.LogWarn("", DEFAULT, "listen, runtimeDir, logModule and timeouts changes require a restart")
+		cfg.Listen, cfg.RuntimeDir, cfg.LogModule = old.Listen, old.RuntimeDir, old.LogModule
+		cfg.Timeouts = old.Timeouts
+	}
+
+	level, _ := logger.ParseLogLevel(cfg.LogLevel)
+	rl.SetLogLevel(level)
+	var removed []string
+	for _, key := range old.LogKeys {
+		if !containsString(cfg.LogKeys, key) {
+			removed = append(removed, key)
+		}
+	}
+	if len(removed) > 0 {
+		rl.DisableKeys(removed)
+	}
+	rl.EnableKeys(cfg.LogKeys)
+
+	currentConfig.Store(cfg)
+	rl.LogInfo("", DEFAULT, "Configuration reloaded")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "retriever.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	return path
+}
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, `{"listen": "127.0.0.1:9000", "runtimeDir": "`+filepath.ToSlash(dir)+`",
+		"logLevel": "warn", "logKeys": ["Retriever"], "timeouts": {"module": "3s"}}`)
+
+	// flags override the file
+	cmd, err := parseFlags([]string{"-config", path, "-log-level", "info", "-file-root", dir})
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	cfg, err := loadConfig(cmd.configFile, cmd.apply)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	if cfg.Listen != "127.0.0.1:9000" || cfg.LogLevel != "info" || len(cfg.LogKeys) != 1 ||
+		len(cfg.FileRoots) != 1 || cfg.FileRoots[0] != dir {
+		t.Errorf("Failed ! unexpected config %+v", cfg)
+	}
+	if time.Duration(cfg.Timeouts.Module) != 3*time.Second || time.Duration(cfg.Timeouts.Read) != DEFAULT_READ_TIMEOUT {
+		t.Errorf("Failed ! unexpected timeouts %+v", cfg.Timeouts)
+	}
+
+	// defaults without a file
+	if cfg, err = loadConfig("", nil); err != nil || cfg.Listen != DEFAULT_LISTEN {
+		t.Errorf("Failed ! unexpected default config %+v %v", cfg, err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	path := writeConfig(t, `{"listen": "8080", "logLevel": "loud", "tls": {"certFile": "/nonexistent.pem"},
+		"fileRoots": ["relative"], "allowedOrigins": ["dashboard"], "timeouts": {"read": "-1s"}}`)
+	_, err := loadConfig(path, nil)
+	if err == nil {
+		t.Fatalf("Failed ! expected validation errors")
+	}
+	for _, expected := range []string{"listen", "logLevel", "tls: certFile and keyFile", "tls.certFile",
+		"fileRoots", "allowedOrigins", "timeouts.read"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Failed ! %s not reported in %s", expected, err.Error())
+		}
+	}
+
+	if _, err = loadConfig(writeConfig(t, `{"listn": ":8080"}`), nil); err == nil {
+		t.Errorf("Failed ! expected unknown field error")
+	}
+	if _, err = loadConfig(writeConfig(t, `{"timeouts": {"read": 30}}`), nil); err == nil {
+		t.Errorf("Failed ! expected duration error")
+	}
+	if _, err = parseFlags([]string{"extra"}); err == nil {
+		t.Errorf("Failed ! expected argument error")
+	}
+}
@@ -33,6 +33,18 @@ func cmdHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Transaction Id: %s\n", alertMessage.TraceId)
 	fmt.Printf("Key %s \n", alertMessage.Key)
 	fmt.Printf("Error Message: %s\n", alertMessage.Message)
+	if alertMessage.Version >= 2 {
+		fmt.Printf("Id: %s Severity: %s\n", alertMessage.Id, alertMessage.Severity)
+		fmt.Printf("Raised: %s on %s pid %d at %s\n", alertMessage.Timestamp, alertMessage.Hostname,
+			alertMessage.Pid, alertMessage.Caller)
+		if len(alertMessage.Labels) > 0 {
+			fmt.Printf("Labels: %v\n", alertMessage.Labels)
+		}
+		if alertMessage.Count > 1 {
+			fmt.Printf("Repeated %d times between %s and %s\n", alertMessage.Count,
+				alertMessage.FirstSeen, alertMessage.LastSeen)
+		}
+	}
 	fmt.Printf("------ End Alert Message ------------ \n")
 
 }
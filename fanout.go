@@ -0,0 +1,145 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/couchbase/retriever/client"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maximum number of modules a command sent to all modules talks to at once
+const FANOUT_CONCURRENCY = 16
+
+// Result of a command for one module
+type ModuleResult struct {
+	Module   string      `json:"module"`
+	Status   int         `json:"status"`             // HTTP status of the command for this module
+	Response interface{} `json:"response,omitempty"` // data returned by the module, if any
+	Error    string      `json:"error,omitempty"`
+	Latency  Duration    `json:"latency"`
+}
+
+// Results of a command sent to all modules, ordered by module name
+type FanOutResult struct {
+	Modules   []ModuleResult `json:"modules"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+}
+
+// runs a command against a module with a client, returning its data or nil
+type moduleCmd func(c *client.Client, module string) (interface{}, error)
+
+// Run cmd against every module concurrently. Requests to the modules end
+// timeout after the start, modules waiting for their turn included, and a
+// module not answering by then is reported as timed out
+func fanOut(modules []string, timeout time.Duration, cmd moduleCmd) *FanOutResult {
+	c := &client.Client{Dir: cl.Dir, Deadline: time.Now().Add(timeout)}
+	res := &FanOutResult{Modules: make([]ModuleResult, len(modules))}
+	sem := make(chan struct{}, FANOUT_CONCURRENCY)
+	var wg sync.WaitGroup
+	for i, module := range modules {
+		wg.Add(1)
+		go func(i int, module string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res.Modules[i] = runModuleCmd(c, module, timeout, cmd)
+		}(i, module)
+	}
+	wg.Wait()
+
+	for _, result := range res.Modules {
+		if result.Status == http.StatusOK {
+			res.Succeeded++
+		} else {
+			res.Failed++
+		}
+	}
+	return res
+}
+
+// run cmd for a module. The client ends the request at its deadline
+func runModuleCmd(c *client.Client, module string, timeout time.Duration, cmd moduleCmd) ModuleResult {
+	start := time.Now()
+	data, err := cmd(c, module)
+	result := ModuleResult{Module: module, Latency: Duration(time.Since(start))}
+	switch {
+	case errors.Is(err, client.ErrTimeout):
+		result.Status = http.StatusGatewayTimeout
+		result.Error = fmt.Sprintf("Module %s: no response after %s", module, timeout)
+	case err != nil:
+		aerr := moduleError(err)
+		result.Status, result.Error = aerr.Status, aerr.Message
+	default:
+		result.Status, result.Response = http.StatusOK, data
+	}
+	return result
+}
+
+// HTTP status of the whole command: OK if every module succeeded, Multi-Status
+// on partial failure, and when all failed their common status or Bad Gateway
+func (res *FanOutResult) status() int {
+	switch {
+	case res.Failed == 0:
+		return http.StatusOK
+	case res.Succeeded > 0:
+		return http.StatusMultiStatus
+	}
+	status := res.Modules[0].Status
+	for _, result := range res.Modules {
+		if result.Status != status {
+			return http.StatusBadGateway
+		}
+	}
+	return status
+}
+
+// send the command to all the modules with a socket of the given kind and
+// answer their results as JSON. ?timeout= overrides the module timeout, up to
+// timeouts.maxModule
+func sendCmdAll(w http.ResponseWriter, r *http.Request, socket string, cmd moduleCmd) {
+	timeout := cl.Timeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		max := time.Duration(config().Timeouts.MaxModule)
+		if max <= 0 {
+			max = DEFAULT_MAX_MODULE_TIMEOUT
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			writeError(w, newAPIError(http.StatusBadRequest, "Invalid timeout %q", value))
+			return
+		} else if d > max {
+			writeError(w, newAPIError(http.StatusBadRequest, "Timeout %s above the maximum %s", d, max))
+			return
+		}
+		timeout = d
+	}
+	if timeout <= 0 {
+		timeout = time.Duration(defaultConfig().Timeouts.Module)
+	}
+
+	modules, err := cl.Modules(socket)
+	if err != nil {
+		rl.LogWarn("", LOGGER, "Unable to list modules %s", err.Error())
+		writeError(w, err)
+		return
+	}
+
+	res := fanOut(modules, timeout, cmd)
+	for _, result := range res.Modules {
+		if result.Error != "" {
+			rl.LogWarn("", LOGGER, "%s", result.Error)
+		}
+	}
+	writeJSON(w, res.status(), res)
+}
@@ -0,0 +1,98 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/retriever/client"
+	"github.com/couchbase/retriever/logger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	cmd := func(c *client.Client, module string) (interface{}, error) {
+		switch module {
+		case "gone":
+			return nil, fmt.Errorf("%w %s", client.ErrModuleNotFound, module)
+		case "slow":
+			// the client ends requests at its deadline
+			time.Sleep(time.Until(c.Deadline))
+			return nil, fmt.Errorf("Module %s: %w", module, client.ErrTimeout)
+		case "rejects":
+			return nil, &client.Error{Module: module, Status: 400, Message: "Invalid level"}
+		}
+		return module, nil
+	}
+
+	start := time.Now()
+	res := fanOut([]string{"a", "gone", "slow", "b"}, 100*time.Millisecond, cmd)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Failed ! modules not queried concurrently, took %s", elapsed)
+	}
+	expected := []struct {
+		module string
+		status int
+	}{{"a", 200}, {"gone", 404}, {"slow", 504}, {"b", 200}}
+	for i, e := range expected {
+		result := res.Modules[i]
+		if result.Module != e.module || result.Status != e.status {
+			t.Errorf("Failed ! expected %s %d got %+v", e.module, e.status, result)
+		}
+		if (result.Status == 200) != (result.Response == e.module && result.Error == "") {
+			t.Errorf("Failed ! unexpected result %+v", result)
+		}
+	}
+	if res.Succeeded != 2 || res.Failed != 2 || res.status() != http.StatusMultiStatus {
+		t.Errorf("Failed ! unexpected counts %d %d", res.Succeeded, res.Failed)
+	}
+
+	if res = fanOut([]string{"rejects", "rejects"}, time.Second, cmd); res.status() != http.StatusBadRequest {
+		t.Errorf("Failed ! expected the common status, got %d", res.status())
+	}
+	if res = fanOut([]string{"rejects", "gone"}, time.Second, cmd); res.status() != http.StatusBadGateway {
+		t.Errorf("Failed ! expected bad gateway, got %d", res.status())
+	}
+	if res = fanOut(nil, time.Second, cmd); res.status() != http.StatusOK || len(res.Modules) != 0 {
+		t.Errorf("Failed ! expected no modules")
+	}
+
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+	defer rl.SetLogLevel(logger.LevelError)
+
+	post := func(path, body string) (int, FanOutResult) {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed ! %s", err.Error())
+		}
+		defer resp.Body.Close()
+		res := FanOutResult{}
+		json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res
+	}
+	status, all := post("/logger/all", `{"Cmd":"level", "Message":"warn"}`)
+	if status != http.StatusOK || all.Failed != 0 || len(all.Modules) == 0 || rl.GetLogLevel() != logger.LevelWarn {
+		t.Errorf("Failed ! unexpected result %d %+v", status, all)
+	}
+	if status, all = post("/logger/all", `{"Cmd":"level", "Message":"loud"}`); status != http.StatusBadRequest ||
+		all.Modules[0].Error == "" {
+		t.Errorf("Failed ! expected bad request, got %d %+v", status, all)
+	}
+	if status, _ = post("/logger/all?timeout=never", `{"Cmd":"rotate"}`); status != http.StatusBadRequest {
+		t.Errorf("Failed ! expected bad request for the timeout, got %d", status)
+	}
+	if status, _ = post("/logger/all?timeout=100h", `{"Cmd":"rotate"}`); status != http.StatusBadRequest {
+		t.Errorf("Failed ! expected bad request for a timeout above the maximum, got %d", status)
+	}
+}
@@ -0,0 +1,247 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const MAX_TRACE_ID_LENGTH = 128
+
+var errFileForbidden = errors.New("File outside the allowed roots")
+
+// trace ids become part of file names
+var traceIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// A log or trace file of a registered module
+type FileInfo struct {
+	Module  string    `json:"module"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Trace   bool      `json:"trace,omitempty"`
+}
+
+// Directories files may be read from: the configured file roots, or the
+// runtime directory if none
+func fileRoots() []string {
+	cfg := config()
+	if len(cfg.FileRoots) > 0 {
+		return cfg.FileRoots
+	}
+	return []string{cfg.RuntimeDir}
+}
+
+// check whether path is root or inside it. Both are clean absolute paths
+func within(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) &&
+		!filepath.IsAbs(rel)
+}
+
+// Resolve a requested path to a regular file inside the allowed roots.
+// Relative paths, ".." elements and symbolic links leading outside the roots
+// are rejected with errFileForbidden. Open the file with openFile, the path
+// may be swapped for a link once resolved
+func resolveFile(path string) (string, error) {
+	real, _, err := resolvePath(path)
+	return real, err
+}
+
+// resolve path and return the file it resolved to
+func resolvePath(path string) (string, os.FileInfo, error) {
+	if path == "" || strings.ContainsRune(path, 0) || !filepath.IsAbs(path) {
+		return "", nil, errFileForbidden
+	}
+	for _, elem := range strings.FieldsFunc(filepath.ToSlash(path), func(r rune) bool { return r == '/' }) {
+		if elem == ".." {
+			return "", nil, errFileForbidden
+		}
+	}
+
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return "", nil, err
+	}
+
+	allowed := false
+	for _, root := range fileRoots() {
+		if rootReal, err := filepath.EvalSymlinks(root); err == nil && within(filepath.Clean(rootReal), real) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", nil, errFileForbidden
+	}
+
+	// a link swapped in since is not a regular file
+	fi, err := os.Lstat(real)
+	if err != nil {
+		return "", nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", nil, errFileForbidden
+	}
+	return real, fi, nil
+}
+
+// Open a file inside the allowed roots with open. The opened file must be the
+// one resolved, or errFileForbidden is returned
+func openFile(path string, open func(string) (*os.File, error)) (*os.File, os.FileInfo, error) {
+	real, resolved, err := resolvePath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := open(real)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := file.Stat()
+	if err == nil && (!fi.Mode().IsRegular() || !os.SameFile(fi, resolved)) {
+		err = errFileForbidden
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, fi, nil
+}
+
+func validTraceId(traceId string) bool {
+	return len(traceId) <= MAX_TRACE_ID_LENGTH && traceIdPattern.MatchString(traceId)
+}
+
+// HTTP status of a file access error
+func fileErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errFileForbidden), errors.Is(err, os.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// directory of the log and trace files of a registered module, the runtime
+// directory if the module did not record one
+func moduleLogDir(logDir string) string {
+	if logDir == "" {
+		return config().RuntimeDir
+	}
+	return logDir
+}
+
+// List the log and trace files of the registered modules that are inside the
+// allowed roots, optionally for one module only
+func moduleFiles(module string) ([]FileInfo, error) {
+	descriptors, err := cl.Registered()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	files := make([]FileInfo, 0)
+	add := func(name string, pattern string, trace bool) {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			file, fi, err := openFile(match, openFollow)
+			if err != nil {
+				continue
+			}
+			path := file.Name()
+			file.Close()
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			files = append(files, FileInfo{Module: name, Path: path, Size: fi.Size(), ModTime: fi.ModTime(), Trace: trace})
+		}
+	}
+
+	for _, d := range descriptors {
+		if module != "" && d.Name != module {
+			continue
+		}
+		dir := moduleLogDir(d.LogDir)
+		add(d.Name, filepath.Join(dir, globEscape(d.Name)+".log"), false)
+		add(d.Name, filepath.Join(dir, globEscape(d.Name)+".log.*"), false)
+		add(d.Name, filepath.Join(dir, "trace_*.log"), true)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// escape the glob metacharacters of a file name as character classes, which
+// unlike backslashes work on Windows
+func globEscape(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune("*?[", r) {
+			b.WriteString("[" + string(r) + "]")
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Return the trace files of a trace id in the log directories of the
+// registered modules, or of one module
+func traceFiles(module string, traceId string) ([]string, error) {
+	if !validTraceId(traceId) {
+		return nil, fmt.Errorf("Invalid trace id %q", traceId)
+	}
+	descriptors, err := cl.Registered()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var paths []string
+	for _, d := range descriptors {
+		if module != "" && d.Name != module {
+			continue
+		}
+		path, err := resolveFile(filepath.Join(moduleLogDir(d.LogDir), "trace_"+traceId+".log"))
+		if err == nil && !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// List the files of the registered modules as JSON. ?module= restricts the
+// list to one module
+func HandleFiles(w http.ResponseWriter, r *http.Request) {
+	rl.LogInfo("", LOGGER, "Received files request")
+	if !authorize(w, r, false) {
+		return
+	}
+
+	files, err := moduleFiles(r.URL.Query().Get("module"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
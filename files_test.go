@@ -0,0 +1,150 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/couchbase/retriever/registry"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFileSandbox(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	logDir := filepath.Join(root, "logs")
+	os.Mkdir(logDir, 0755)
+	for name, content := range map[string]string{
+		"testfiles.log":          "current log",
+		"testfiles.log.20261018": "rotated log",
+		"trace_0x01.log":         "trace",
+		"other.log":              "not owned",
+	} {
+		os.WriteFile(filepath.Join(logDir, name), []byte(content), 0600)
+	}
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+
+	cfg := defaultConfig()
+	cfg.RuntimeDir = testDir
+	cfg.FileRoots = []string{root}
+	setConfig(t, cfg)
+
+	regDir := registry.Dir(testDir)
+	if err := registry.Register(regDir, "stats", "testfiles", filepath.Join(testDir, "stats_testfiles.sock"), nil); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	defer registry.Unregister(regDir, "stats", "testfiles")
+	registry.SetLogDir(regDir, "testfiles", logDir)
+
+	if path, err := resolveFile(filepath.Join(logDir, "testfiles.log")); err != nil || filepath.Base(path) != "testfiles.log" {
+		t.Errorf("Failed ! expected file inside root %s %v", path, err)
+	}
+	rejected := []string{
+		"",
+		"testfiles.log",
+		filepath.Join(outside, "secret"),
+		logDir + string(filepath.Separator) + ".." + string(filepath.Separator) + "logs" +
+			string(filepath.Separator) + "testfiles.log",
+		logDir,
+	}
+	if runtime.GOOS != "windows" {
+		// symbolic links are resolved before checking the roots
+		os.Symlink(filepath.Join(outside, "secret"), filepath.Join(logDir, "link.log"))
+		rejected = append(rejected, filepath.Join(logDir, "link.log"), "/etc/passwd")
+	}
+	for _, path := range rejected {
+		if _, err := resolveFile(path); !errors.Is(err, errFileForbidden) {
+			t.Errorf("Failed ! expected %q rejected, got %v", path, err)
+		}
+	}
+	if _, err := resolveFile(filepath.Join(logDir, "missing.log")); fileErrorStatus(err) != http.StatusNotFound {
+		t.Errorf("Failed ! expected not found %v", err)
+	}
+
+	if file, _, err := openFile(filepath.Join(logDir, "testfiles.log"), os.Open); err != nil {
+		t.Errorf("Failed ! expected file opened %v", err)
+	} else {
+		file.Close()
+	}
+	if runtime.GOOS != "windows" {
+		// the file is swapped for a link once resolved
+		swapped := filepath.Join(logDir, "swapped.log")
+		os.WriteFile(swapped, []byte("log"), 0600)
+		swap := func(path string) (*os.File, error) {
+			os.Remove(path)
+			os.Symlink(filepath.Join(outside, "secret"), path)
+			return os.Open(path)
+		}
+		if _, _, err := openFile(swapped, swap); !errors.Is(err, errFileForbidden) {
+			t.Errorf("Failed ! expected swapped file rejected, got %v", err)
+		}
+		os.Remove(swapped)
+	}
+
+	for _, id := range []string{"../../etc/passwd", "*", "..", "a/b", strings.Repeat("x", 200)} {
+		if _, err := traceFiles("", id); err == nil {
+			t.Errorf("Failed ! expected trace id %q rejected", id)
+		}
+	}
+	if paths, err := traceFiles("testfiles", "0x01"); err != nil || len(paths) != 1 {
+		t.Errorf("Failed ! expected trace file %v %v", paths, err)
+	}
+
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/files?module=testfiles")
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	var files []FileInfo
+	json.NewDecoder(resp.Body).Decode(&files)
+	resp.Body.Close()
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f.Path))
+	}
+	if strings.Join(names, ",") != "testfiles.log,testfiles.log.20261018,trace_0x01.log" {
+		t.Errorf("Failed ! unexpected files %v", names)
+	}
+
+	post := func(body string) (int, string) {
+		resp, err := http.Post(srv.URL+"/logger/testfiles", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed ! %s", err.Error())
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	if status, body := post(`{"Cmd":"file","Message":` + quote(filepath.Join(logDir, "other.log")) + `}`); status != http.StatusOK || body != "not owned" {
+		t.Errorf("Failed ! expected file inside root %d %s", status, body)
+	}
+	if status, _ := post(`{"Cmd":"file","Message":` + quote(filepath.Join(outside, "secret")) + `}`); status != http.StatusForbidden {
+		t.Errorf("Failed ! expected forbidden file, got %d", status)
+	}
+	if status, body := post(`{"Cmd":"traceLog","Message":"0x01"}`); status != http.StatusOK || body != "trace" {
+		t.Errorf("Failed ! expected trace log %d %s", status, body)
+	}
+	if status, _ := post(`{"Cmd":"traceLog","Message":"../../secret"}`); status != http.StatusBadRequest {
+		t.Errorf("Failed ! expected bad trace id, got %d", status)
+	}
+}
+
+func quote(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
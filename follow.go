@@ -0,0 +1,265 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/retriever/logger"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// interval between checks of a followed file for new lines and rotation
+const FOLLOW_POLL_INTERVAL = 250 * time.Millisecond
+
+// interval of keep-alive messages on idle streams
+const FOLLOW_HEARTBEAT = 15 * time.Second
+
+// Event sent to followers of a file, as JSON
+type followEvent struct {
+	Event   string `json:"event"`  // line, or rotate when reading restarts at the start of a file
+	Offset  int64  `json:"offset"` // position after the line in the current file, to resume from
+	Line    string `json:"line,omitempty"`
+	Level   string `json:"level,omitempty"`
+	Key     string `json:"key,omitempty"`
+	TraceId string `json:"traceId,omitempty"`
+}
+
+// delivers events over SSE or WebSocket
+type eventWriter interface {
+	WriteEvent(ev *followEvent) error
+	Heartbeat() error
+	Done() <-chan struct{}
+}
+
+// Lines wanted by a follower
+type lineFilter struct {
+	level   logger.LogLevel // most verbose level, LevelGlobal for all
+	keys    map[string]bool // all keys if empty
+	traceId string
+}
+
+// Build a filter from the level, key and trace parameters. key may be repeated
+// or a comma separated list
+func parseFilter(query url.Values) (*lineFilter, error) {
+	filter := &lineFilter{level: logger.LevelGlobal, keys: make(map[string]bool)}
+	if value := query.Get("level"); value != "" {
+		level, err := logger.ParseLogLevel(value)
+		if err != nil {
+			return nil, err
+		}
+		filter.level = level
+	}
+	for _, value := range query["key"] {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				filter.keys[key] = true
+			}
+		}
+	}
+	if filter.traceId = query.Get("trace"); filter.traceId != "" && !validTraceId(filter.traceId) {
+		return nil, fmt.Errorf("Invalid trace id %q", filter.traceId)
+	}
+	return filter, nil
+}
+
+// Lines that do not carry their level are kept by a level filter
+func (f *lineFilter) match(info logger.LineInfo) bool {
+	if f.level != logger.LevelGlobal && info.Level != logger.LevelGlobal && info.Level > f.level {
+		return false
+	}
+	if len(f.keys) > 0 && !f.keys[info.Key] {
+		return false
+	}
+	return f.traceId == "" || info.TraceId == f.traceId
+}
+
+type sseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	r  *http.Request
+}
+
+func newSSEWriter(w http.ResponseWriter, r *http.Request) *sseWriter {
+	sw := &sseWriter{w: w, rc: http.NewResponseController(w), r: r}
+	// streams outlive the read and write timeouts of the server
+	sw.rc.SetReadDeadline(time.Time{})
+	sw.rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	sw.rc.Flush()
+	return sw
+}
+
+// The id of an event is its offset, sent back by browsers as Last-Event-ID
+// when reconnecting
+func (sw *sseWriter) WriteEvent(ev *followEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(sw.w, "id: %d\ndata: %s\n\n", ev.Offset, data); err != nil {
+		return err
+	}
+	return sw.rc.Flush()
+}
+
+func (sw *sseWriter) Heartbeat() error {
+	if _, err := fmt.Fprint(sw.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	return sw.rc.Flush()
+}
+
+func (sw *sseWriter) Done() <-chan struct{} {
+	return sw.r.Context().Done()
+}
+
+type wsWriter struct {
+	*wsConn
+}
+
+func (ww wsWriter) WriteEvent(ev *followEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return ww.WriteText(data)
+}
+
+func (ww wsWriter) Heartbeat() error {
+	return ww.Ping()
+}
+
+// Parse the starting offset: none follows from the end, a negative offset
+// counts back from the end. Without an offset a Last-Event-ID resumes an SSE
+// stream
+func parseOffset(r *http.Request) (int64, bool, error) {
+	value := r.URL.Query().Get("offset")
+	if value == "" {
+		value = r.Header.Get("Last-Event-ID")
+	}
+	if value == "" {
+		return 0, true, nil
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid offset %q", value)
+	}
+	return offset, offset < 0, nil
+}
+
+// Stream the lines appended to a file over WebSocket when the request asks for
+// an upgrade, otherwise as Server-Sent Events
+func followFile(w http.ResponseWriter, r *http.Request, path string) error {
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "%s", err.Error())
+	}
+	offset, relative, err := parseOffset(r)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "%s", err.Error())
+	}
+	t, err := openTail(path, offset, relative)
+	if err != nil {
+		return newAPIError(fileErrorStatus(err), "%s", err.Error())
+	}
+	defer t.Close()
+
+	var out eventWriter
+	if isWebSocket(r) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return err
+		}
+		defer ws.Close()
+		out = wsWriter{ws}
+	} else {
+		out = newSSEWriter(w, r)
+	}
+
+	rl.LogInfo("", LOGGER, "Following %s from %s", path, r.RemoteAddr)
+	// the response has started, errors can only end the stream
+	if err = follow(t, filter, out); err != nil {
+		rl.LogInfo("", LOGGER, "Stopped following %s for %s: %s", path, r.RemoteAddr, err.Error())
+	}
+	return nil
+}
+
+// send the lines of the file matching the filter until the follower goes away
+func follow(t *tailer, filter *lineFilter, out eventWriter) error {
+	emit := func(line string, offset int64) error {
+		info := logger.ParseLine(line)
+		if !filter.match(info) {
+			return nil
+		}
+		ev := &followEvent{Event: "line", Offset: offset, Line: info.Text, Key: info.Key, TraceId: info.TraceId}
+		if info.Level != logger.LevelGlobal {
+			ev.Level = info.Level.String()
+		}
+		return out.WriteEvent(ev)
+	}
+
+	poll := time.NewTicker(FOLLOW_POLL_INTERVAL)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(FOLLOW_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		if err := t.read(emit); err != nil {
+			return err
+		}
+		select {
+		case <-out.Done():
+			return nil
+		case <-heartbeat.C:
+			if err := out.Heartbeat(); err != nil {
+				return err
+			}
+		case <-poll.C:
+			restarted, err := t.reopen(emit)
+			if err != nil {
+				return err
+			}
+			if restarted {
+				if err = out.WriteEvent(&followEvent{Event: "rotate"}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Follow the log file of a running module
+func v2FollowLog(w http.ResponseWriter, r *http.Request) error {
+	d, err := cl.Lookup(mux.Vars(r)["module"])
+	if err != nil {
+		return moduleError(err)
+	}
+	return followFile(w, r, filepath.Join(moduleLogDir(d.LogDir), d.Name+".log"))
+}
+
+// Follow a trace log, which may be removed once idle
+func v2FollowTrace(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	paths, err := traceFiles(vars["module"], vars["traceId"])
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "%s", err.Error())
+	} else if len(paths) == 0 {
+		return newAPIError(http.StatusNotFound, "Trace log %s not found", vars["traceId"])
+	}
+	return followFile(w, r, paths[0])
+}
@@ -0,0 +1,270 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/retriever/logger"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTail(t *testing.T) {
+	path := filepath.Join(testDir, "tail.log")
+	if err := os.WriteFile(path, []byte("one\ntwo\nthr"), 0666); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	defer os.Remove(path)
+
+	var lines []string
+	emit := func(line string, offset int64) error {
+		lines = append(lines, line)
+		return nil
+	}
+	expect := func(what string, expected ...string) {
+		t.Helper()
+		if strings.Join(lines, ",") != strings.Join(expected, ",") {
+			t.Errorf("Failed ! %s: expected %q got %q", what, expected, lines)
+		}
+		lines = nil
+	}
+	appendFile := func(path, text string) {
+		fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatalf("Failed ! %s", err.Error())
+		}
+		fp.WriteString(text)
+		fp.Close()
+	}
+
+	// starting inside a line skips it
+	tl, err := openTail(path, -6, true)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	tl.read(emit)
+	appendFile(path, "ee\n")
+	tl.read(emit)
+	expect("relative offset", "three")
+	tl.Close()
+
+	tl, err = openTail(path, 4, false)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	defer tl.Close()
+	tl.read(emit)
+	expect("absolute offset", "two", "three")
+
+	// lines written before the rotation are read from the old file
+	appendFile(path, "four\n")
+	os.Rename(path, path+".1")
+	defer os.Remove(path + ".1")
+	if restarted, err := tl.reopen(emit); restarted || err != nil {
+		t.Errorf("Failed ! reopened before the new file exists %v", err)
+	}
+	appendFile(path, "five\n")
+	if restarted, err := tl.reopen(emit); !restarted || err != nil {
+		t.Errorf("Failed ! rotation not detected %v", err)
+	}
+	tl.read(emit)
+	expect("rotation", "four", "five")
+
+	os.WriteFile(path, []byte("six\n"), 0666)
+	if restarted, err := tl.reopen(emit); !restarted || err != nil {
+		t.Errorf("Failed ! truncation not detected %v", err)
+	}
+	tl.read(emit)
+	expect("truncation", "six")
+
+	if _, err = openTail(filepath.Join(os.TempDir(), "..", "etc", "passwd"), 0, false); err == nil {
+		t.Errorf("Failed ! followed a file outside the roots")
+	}
+}
+
+func TestFollow(t *testing.T) {
+	mylog, err := logger.NewLoggerOptions("testfollow", logger.LevelDebug, logger.LoggerOptions{RuntimeDir: testDir})
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	// left over by earlier runs
+	os.Truncate(mylog.GetFilePath(), 0)
+	mylog.SetColor(true)
+	mylog.EnableKeys([]string{"DCP", "Index"})
+	// the module registers its log directory once listening
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if d, err := cl.Lookup("testfollow"); err == nil && d.LogDir != "" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Failed ! module not registered %v", err)
+		}
+	}
+
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	for _, bad := range []string{"?level=loud", "?offset=start", "?trace=a/b"} {
+		resp, err := http.Get(srv.URL + "/api/v2/modules/testfollow/logs/follow" + bad)
+		if err != nil {
+			t.Fatalf("Failed ! %s", err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Failed ! %s: expected bad request got %d", bad, resp.StatusCode)
+		}
+	}
+
+	// pages of other origins may not open WebSockets
+	for _, origin := range []string{"http://evil.example", "null"} {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/v2/modules/testfollow/logs/follow", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")))
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed ! %s", err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Failed ! WebSocket from origin %s: expected forbidden got %d", origin, resp.StatusCode)
+		}
+	}
+	cfg := *config()
+	cfg.AllowedOrigins = []string{"https://dashboard.example/"}
+	setConfig(t, &cfg)
+	for origin, allowed := range map[string]bool{"": true, "http://retriever.local:8080": true,
+		"https://dashboard.example": true, "http://dashboard.example": false, "https://evil.example": false} {
+		req := httptest.NewRequest("GET", "http://retriever.local:8080/", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if allowedOrigin(req) != allowed {
+			t.Errorf("Failed ! origin %q expected allowed %v", origin, allowed)
+		}
+	}
+
+	mylog.LogError("", "DCP", "before following")
+	resp, err := http.Get(srv.URL + "/api/v2/modules/testfollow/logs/follow?offset=0&level=warn&key=DCP")
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Failed ! unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan followEvent, 10)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				ev := followEvent{}
+				json.Unmarshal([]byte(data), &ev)
+				events <- ev
+			}
+		}
+		close(events)
+	}()
+	next := func() followEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Failed ! no event")
+		}
+		return followEvent{}
+	}
+
+	mylog.LogInfo("", "DCP", "filtered by level")
+	mylog.LogError("", "Index", "filtered by key")
+	mylog.LogWarn("", "DCP", "before rotation")
+	if err = mylog.Rotate(); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	mylog.LogWarn("0x42", "DCP", "after rotation")
+
+	expected := []followEvent{
+		{Event: "line", Level: "error", Key: "DCP", Line: "before following"},
+		{Event: "line", Level: "warn", Key: "DCP", Line: "before rotation"},
+		{Event: "rotate"},
+		{Event: "line", Level: "warn", Key: "DCP", TraceId: "0x42", Line: "after rotation"},
+	}
+	for _, e := range expected {
+		ev := next()
+		if ev.Event != e.Event || ev.Level != e.Level || ev.Key != e.Key || ev.TraceId != e.TraceId ||
+			!strings.HasSuffix(ev.Line, e.Line) {
+			t.Errorf("Failed ! expected %+v got %+v", e, ev)
+		}
+	}
+
+	// trace logs over WebSocket
+	mylog.EnableTraceLogging()
+	defer mylog.DisableTraceLogging()
+	traceId := fmt.Sprintf("0x%x", time.Now().UnixNano())
+	mylog.LogInfo(traceId, "Index", "traced")
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	io.WriteString(conn, "GET /api/v2/modules/testfollow/traces/"+traceId+"/follow?offset=0 HTTP/1.1\r\nHost: test\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+key+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	upgrade, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	sum := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	if upgrade.StatusCode != http.StatusSwitchingProtocols ||
+		upgrade.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("Failed ! unexpected handshake %d %v", upgrade.StatusCode, upgrade.Header)
+	}
+
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(br, header); err != nil || header[0] != 0x80|WS_TEXT || header[1] > 126 {
+		t.Fatalf("Failed ! unexpected frame %x %v", header, err)
+	}
+	size := int(header[1])
+	if size == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(br, ext)
+		size = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, size)
+	io.ReadFull(br, payload)
+	ev := followEvent{}
+	if err = json.Unmarshal(payload, &ev); err != nil || ev.TraceId != traceId || !strings.HasSuffix(ev.Line, "traced") {
+		t.Errorf("Failed ! unexpected message %s", payload)
+	}
+
+	// masked close frame with status 1000, answered with a close frame
+	conn.Write([]byte{0x80 | WS_CLOSE, 0x82, 1, 2, 3, 4, 0x03 ^ 1, 0xE8 ^ 2})
+	if _, err = io.ReadFull(br, header); err != nil || header[0] != 0x80|WS_CLOSE {
+		t.Errorf("Failed ! expected a close frame got %x %v", header, err)
+	}
+}
@@ -10,14 +10,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/couchbase/retriever/client"
+	"github.com/couchbase/retriever/protocol"
 	"github.com/gorilla/mux"
 	"io"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 )
 
@@ -26,15 +27,7 @@ type message struct {
 	Message string
 }
 
-func getDefaultPath() string {
-	if runtime.GOOS == "windows" {
-		return os.Getenv("tmp")
-	} else {
-		return "/tmp"
-	}
-}
-
-const DEFAULT_PIPE_PATH = `\\.\pipe\`
+var errInvalidCommand = errors.New("Invalid Command")
 
 func HandleLoggerCmds(w http.ResponseWriter, r *http.Request) {
 	msg := message{}
@@ -48,127 +41,147 @@ func HandleLoggerCmds(w http.ResponseWriter, r *http.Request) {
 
 	err := decoder.Decode(&msg)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Invalid request "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, mutatingCommand(msg.Cmd)) {
+		return
 	}
 
 	// Send commands to all modules
 	if strings.ToLower(module) == "all" {
-		var pattern string
 		switch msg.Cmd {
 		case "log":
-			pattern = getDefaultPath() + "/*.log*"
-			scanLogs(w, pattern)
+			files, err := moduleFiles("")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			var paths []string
+			for _, f := range files {
+				if !f.Trace {
+					paths = append(paths, f.Path)
+				}
+			}
+			scanLogs(w, paths)
 		case "traceLog":
-			pattern = getDefaultPath() + "/trace_" + msg.Message + ".log"
-			scanLogs(w, pattern)
-		case "level":
-			requestStr := "level:" + msg.Message
-			pattern = getDefaultPath() + "/*.sock"
-			sendCmdAll(w, requestStr, pattern)
-		case "rotate":
-			requestStr := "rotate:"
-			pattern = getDefaultPath() + "/*.sock"
-			sendCmdAll(w, requestStr, pattern)
-		case "traceEnable":
-			requestStr := "trace:"
-			pattern = getDefaultPath() + "/*.sock"
-			sendCmdAll(w, requestStr, pattern)
-		case "traceDisable":
-			requestStr := "traceoff:"
-			pattern = getDefaultPath() + "/*.sock"
-			sendCmdAll(w, requestStr, pattern)
-		case "alarmSet":
-			requestStr := "alarm:" + msg.Message
-			pattern = getDefaultPath() + "/*.sock"
-			sendCmdAll(w, requestStr, pattern)
-		case "alarmClear":
-			requestStr := "alarmoff:"
-			pattern = getDefaultPath() + "/*.sock"
-			sendCmdAll(w, requestStr, pattern)
+			paths, err := traceFiles("", msg.Message)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			scanLogs(w, paths)
+		case "level", "rotate", "traceEnable", "traceDisable", "alarmSet", "alarmClear", "alarmList":
+			sendCmdAll(w, r, client.LogSocket, func(c *client.Client, module string) (interface{}, error) {
+				return loggerCmd(c, module, msg)
+			})
 		default:
-			http.Error(w, "Invalid Command", http.StatusInternalServerError)
+			http.Error(w, errInvalidCommand.Error(), http.StatusBadRequest)
 		}
 
 		return
 	}
 
-	var requestStr string
-	stream := false
-
 	switch msg.Cmd {
-	case "level":
-		requestStr = "level:" + msg.Message
-	case "trace":
-		requestStr = "trace:" + msg.Message
 	case "traceLog":
 		if msg.Message == "" {
-			http.Error(w, "Missing trace Id", http.StatusInternalServerError)
+			http.Error(w, "Missing trace Id", http.StatusBadRequest)
+			return
+		}
+		paths, err := traceFiles(module, msg.Message)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if len(paths) == 0 {
+			http.Error(w, "Trace log "+msg.Message+" not found", http.StatusNotFound)
 			return
 		}
-		requestStr = getDefaultPath() + "/" + "trace_" + msg.Message + ".log"
-		stream = true
+		streamLog(w, paths[0])
 	case "log":
-		requestStr = getDefaultPath() + "/" + module + ".log"
-		stream = true
+		// the module knows where its log file is, read it directly if it is not running
+		reader, err := cl.StreamLog(module)
+		if errors.Is(err, client.ErrModuleNotFound) {
+			streamLog(w, filepath.Join(cl.Dir, module+".log"))
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer reader.Close()
+		io.Copy(w, reader)
 	case "file":
-		requestStr = msg.Message
-		stream = true
-	case "loglist":
-		requestStr = "loglist:"
-	case "rotate":
-		requestStr = "rotate:"
-	case "traceEnable":
-		requestStr = "trace:"
-	case "traceDisable":
-		requestStr = "traceoff:"
-	case "alarmSet":
-		requestStr = "alarm:" + msg.Message
-	case "alarmClear":
-		requestStr = "alarmoff:"
-	case "path":
-		requestStr = "setpath:" + msg.Message
+		streamLog(w, msg.Message)
 	default:
-		http.Error(w, "Invalid Command", http.StatusInternalServerError)
-		return
-
-	}
-
-	if stream == false {
-		// connect to the module to check if the target process is running
-		var module_path string
-		if runtime.GOOS == "windows" {
-			module_path = DEFAULT_PIPE_PATH + "log_" + module + ".pipe"
-		} else {
-			module_path = getDefaultPath() + "/" + "log_" + module + ".sock"
-		}
-
-		c, err := connect(module_path)
-
-		if err != nil {
+		response, err := loggerCmd(cl, module, msg)
+		if errors.Is(err, errInvalidCommand) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if errors.Is(err, client.ErrModuleNotFound) {
 			err_msg := "Module " + module + " not found.  Err  " + err.Error()
 			http.Error(w, err_msg, http.StatusInternalServerError)
 			return
+		} else if err != nil {
+			io.WriteString(w, err.Error())
+			return
+		}
+		switch data := response.(type) {
+		case nil:
+			io.WriteString(w, "OK")
+		case string:
+			io.WriteString(w, data)
+		default:
+			text, _ := json.Marshal(data)
+			w.Write(text)
 		}
-		defer c.Close()
-
-		response := sendCmd(c, w, requestStr)
-		io.WriteString(w, response)
-	} else {
-		//stream data to the user
-		streamLog(w, requestStr)
 	}
+}
 
+// run a logger command against a module and return its data, nil if none
+func loggerCmd(c *client.Client, module string, msg message) (interface{}, error) {
+	var err error
+	switch msg.Cmd {
+	case "level":
+		err = c.SetLevel(module, msg.Message)
+	case "trace", "traceEnable":
+		err = c.EnableTrace(module, true)
+	case "traceDisable":
+		err = c.EnableTrace(module, false)
+	case "rotate":
+		err = c.Rotate(module)
+	case "keys":
+		err = c.EnableKeys(module, strings.Split(msg.Message, ","))
+	case "alarmSet":
+		err = c.SetAlarm(module, msg.Message)
+	case "alarmClear":
+		err = c.ClearAlarm(module, msg.Message)
+	case "alarmList":
+		targets, err := c.AlarmTargets(module)
+		if err != nil {
+			return nil, err
+		}
+		return targets, nil
+	case "path":
+		err = c.SetPath(module, msg.Message)
+	case "loglist":
+		var resp *protocol.Response
+		if resp, err = c.Call(client.LogSocket, module, protocol.NewRequest("loglist")); err == nil {
+			return resp.Text(), nil
+		}
+	default:
+		return nil, errInvalidCommand
+	}
+	return nil, err
 }
 
+// stream a file inside the allowed roots
 func streamLog(w http.ResponseWriter, filePath string) {
 
-	file, err := os.OpenFile(filePath, os.O_RDWR, 0666)
-
 	rl.LogInfo("", LOGGER, "Opening file %s", filePath)
+	file, _, err := openFile(filePath, os.Open)
 	if err != nil {
 		errMsg := "Cannot open file." + "Error: " + err.Error()
 		rl.LogWarn("", LOGGER, errMsg)
-		http.Error(w, errMsg, http.StatusInternalServerError)
+		http.Error(w, errMsg, fileErrorStatus(err))
 		return
 	}
 	defer file.Close()
@@ -176,98 +189,22 @@ func streamLog(w http.ResponseWriter, filePath string) {
 	io.Copy(w, file)
 }
 
-func sendCmd(c net.Conn, w http.ResponseWriter, message string) string {
-
-	//set the log level and wait for status
-	_, err := c.Write([]byte(message))
-
-	if err != nil {
-		errMsg := "Error communicating with module. Reason : " + err.Error()
-		rl.LogWarn("", LOGGER, errMsg)
-		return errMsg
-	}
-
-	buf := make([]byte, 1024)
-	n, err := c.Read(buf[:])
-	if err != nil {
-		errMsg := "Error communicating with module. Reason : " + err.Error()
-		rl.LogWarn("", getDefaultPath(), errMsg)
-		return errMsg
-
-	}
-
-	// all okay return response to the client
-	return string(buf[0:n])
-}
-
-// send the command to all the units operating on this server
-func sendCmdAll(w http.ResponseWriter, message string, pattern string) {
-
-	fileList, err := filepath.Glob(pattern)
-	if err != nil {
-		rl.LogWarn("", LOGGER, "No files found for pattern %s", pattern)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if len(fileList) == 0 {
-		fmt.Fprintf(w, "No logs found for pattern %s", pattern)
-		return
-	}
-
-	fail := 0
-	for _, fileName := range fileList {
-
-		if runtime.GOOS == "windows" {
-			// extract the module name from the filelist
-			basePath := filepath.Base(fileName)
-			splits := strings.Split(basePath, ".")
-			moduleName := splits[0]
-			fileName = DEFAULT_PIPE_PATH + moduleName + ".pipe"
-		}
-
-		c, err := connect(fileName)
-
-		if err != nil {
-			fmt.Fprintf(w, "%s \n", err.Error())
-			fail++
-			rl.LogWarn("", LOGGER, err.Error())
-			continue
-		}
-		defer c.Close()
-
-		response := sendCmd(c, w, message)
-		fmt.Fprintf(w, "%s %s\n", fileName, response)
-	}
-	if fail > 0 {
-		fmt.Fprintf(w, "Failures %d", fail)
-	} else {
-		io.WriteString(w, "All OK")
-	}
-
-}
-
-func scanLogs(w http.ResponseWriter, pattern string) {
-
-	fileList, err := filepath.Glob(pattern)
-	if err != nil {
-		rl.LogWarn("", LOGGER, "No files found for pattern %s", pattern)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// concatenate files already resolved inside the allowed roots
+func scanLogs(w http.ResponseWriter, fileList []string) {
 
 	if len(fileList) == 0 {
-		fmt.Fprintf(w, "No logs found for pattern %s", pattern)
+		io.WriteString(w, "No logs found")
 		return
 	}
 
 	for _, fileName := range fileList {
-		fp, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+		fp, _, err := openFile(fileName, os.Open)
 		if err != nil {
 			rl.LogWarn("", LOGGER, err.Error())
 			continue
 		}
 		fmt.Fprintf(w, "\n---- file %s ----- \n", fileName)
 		io.Copy(w, fp)
+		fp.Close()
 	}
 }
@@ -0,0 +1,30 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// List the running modules from the registry as JSON
+func HandleModules(w http.ResponseWriter, r *http.Request) {
+	rl.LogInfo("", LOGGER, "Received modules request")
+	if !authorize(w, r, false) {
+		return
+	}
+
+	modules, err := cl.Registered()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(modules)
+}
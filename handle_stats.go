@@ -10,10 +10,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/couchbase/retriever/client"
 	"github.com/gorilla/mux"
 	"io"
 	"net/http"
-	"runtime"
 	"strings"
 )
 
@@ -28,37 +29,32 @@ func HandleStatsCmds(w http.ResponseWriter, r *http.Request) {
 	// Connect to the module
 	decoder := json.NewDecoder(r.Body)
 
+	// the body is optional
 	err := decoder.Decode(&msg)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err != nil && err != io.EOF {
+		http.Error(w, "Invalid request "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, false) {
+		return
 	}
 
 	// Send commands to all modules
-	requestStr := "stats:"
 	if strings.ToLower(module) == "all" {
-		pattern := getDefaultPath() + "/stats_*.sock"
-		sendCmdAll(w, requestStr, pattern)
+		sendCmdAll(w, r, client.StatsSocket, func(c *client.Client, module string) (interface{}, error) {
+			return c.GetStats(module)
+		})
 		return
 	}
 
-	// connect to the module to check if the target process is running
-	var module_path string
-	if runtime.GOOS == "windows" {
-		module_path = DEFAULT_PIPE_PATH + "stats_" + module + ".pipe"
-	} else {
-		module_path = getDefaultPath() + "/stats_" + module + ".sock"
-	}
-
-	c, err := connect(module_path)
-
-	if err != nil {
+	stats, err := cl.GetStats(module)
+	if errors.Is(err, client.ErrModuleNotFound) {
 		err_msg := "Module " + module + " not found.  Err  " + err.Error()
 		http.Error(w, err_msg, http.StatusInternalServerError)
 		return
+	} else if err != nil {
+		io.WriteString(w, err.Error())
+		return
 	}
-	defer c.Close()
-
-	response := sendCmd(c, w, requestStr)
-	io.WriteString(w, response)
-
+	w.Write(stats)
 }
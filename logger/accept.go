@@ -12,10 +12,11 @@ package logger
 
 import (
 	"fmt"
+	"github.com/couchbase/retriever/protocol"
+	"github.com/couchbase/retriever/registry"
 	"log"
 	"net"
 	"os"
-	"strings"
 )
 
 func handleConnections(lw *LogWriter, module string) {
@@ -28,7 +29,7 @@ func doHandleConnections(lw *LogWriter, module string) {
 
 	// create an I/O channel based on the module name
 	// for the server to connect to
-	sock := getDefaultPath() + pathSeparator() + "log_" + module + ".sock"
+	sock := lw.runtimeDir + pathSeparator() + "log_" + module + ".sock"
 	os.Remove(sock)
 	listener, err := net.Listen("unix", sock)
 
@@ -39,6 +40,16 @@ func doHandleConnections(lw *LogWriter, module string) {
 	defer os.Remove(sock)
 	defer listener.Close()
 
+	// let clients discover the socket
+	regDir := registry.Dir(lw.runtimeDir)
+	if err = registry.Register(regDir, "log", module, sock, logCommands); err != nil {
+		fmt.Printf("Unable to register module %s\n", err.Error())
+	}
+	defer registry.Unregister(regDir, "log", module)
+	lw.fileMu.RLock()
+	lw.registerLogDir(lw.logDirLocked())
+	lw.fileMu.RUnlock()
+
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println("Recovered in f", r)
@@ -51,16 +62,9 @@ func doHandleConnections(lw *LogWriter, module string) {
 			fmt.Printf("Unable to accept " + err.Error()) // FIXME
 			continue
 		}
-		buf := make([]byte, 512)
-		nr, err := c.Read(buf)
-		if err != nil {
-			fmt.Printf(" Could not read from buffer %s", err.Error())
-			c.Close()
-			continue
-		}
-		data := string(buf[0:nr])
-		cmds := strings.SplitN(data, ":", 2)
-		handleCommand(lw, c, cmds, data)
+		protocol.Serve(c, func(req *protocol.Request) *protocol.Response {
+			return handleRequest(lw, req)
+		})
 		c.Close()
 	}
 }
@@ -12,10 +12,11 @@ package logger
 
 import (
 	"fmt"
+	"github.com/couchbase/retriever/protocol"
+	"github.com/couchbase/retriever/registry"
 	"github.com/natefinch/npipe"
 	"log"
 	"os"
-	"strings"
 )
 
 func handleConnections(lw *LogWriter, module string) {
@@ -24,13 +25,13 @@ func handleConnections(lw *LogWriter, module string) {
 	}
 }
 
-const DEFAULT_PIPE_PATH = `\\.\pipe\`
+const DEFAULT_PIPE_PATH = registry.PIPE_PATH
 
 func doHandleConnections(lw *LogWriter, module string) {
 
 	// create an I/O channel based on the module name
 	// for the server to connect to
-	pipename := DEFAULT_PIPE_PATH + "log_" + module + ".pipe"
+	pipename := registry.PipeName(lw.runtimeDir, "log_"+module)
 	os.Remove(pipename)
 	listener, err := npipe.Listen(pipename)
 	if err != nil {
@@ -39,18 +40,15 @@ func doHandleConnections(lw *LogWriter, module string) {
 	defer os.Remove(pipename)
 	defer listener.Close()
 
-	// create a file entry for the pipe in the default pathname so that clients
-	// can discover the pipe entry
-	pipeEntry := getDefaultPath() + pathSeparator() + "log_" + module + ".sock"
-	os.Remove(pipeEntry)
-
-	fp, err := os.OpenFile(pipeEntry, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatal("Unable to open file %s", err.Error())
+	// let clients discover the pipe
+	regDir := registry.Dir(lw.runtimeDir)
+	if err = registry.Register(regDir, "log", module, pipename, logCommands); err != nil {
+		fmt.Printf("Unable to register module %s\n", err.Error())
 	}
-
-	defer fp.Close()
-	defer os.Remove(pipeEntry)
+	defer registry.Unregister(regDir, "log", module)
+	lw.fileMu.RLock()
+	lw.registerLogDir(lw.logDirLocked())
+	lw.fileMu.RUnlock()
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -64,16 +62,9 @@ func doHandleConnections(lw *LogWriter, module string) {
 			fmt.Printf("Unable to accept " + err.Error()) // FIXME
 			continue
 		}
-		buf := make([]byte, 512)
-		nr, err := c.Read(buf)
-		if err != nil {
-			fmt.Printf(" Could not read from buffer %s", err.Error())
-			c.Close()
-			continue
-		}
-		data := string(buf[0:nr])
-		cmds := strings.SplitN(data, ":", 2)
-		handleCommand(lw, c, cmds, data)
+		protocol.Serve(c, func(req *protocol.Request) *protocol.Response {
+			return handleRequest(lw, req)
+		})
 		c.Close()
 	}
 }
@@ -0,0 +1,606 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ALARM_QUEUE_SIZE = 256
+const ALARM_MAX_RETRIES = 5
+const ALARM_MIN_BACKOFF = 500 * time.Millisecond
+const ALARM_MAX_BACKOFF = 30 * time.Second
+const ALARM_REQUEST_TIMEOUT = 10 * time.Second
+const ALARM_BATCH_DELAY = time.Second
+
+// version of the AlarmMessage payload. Version 1 carried Module, TraceId, Key
+// and Message only and had no Version field
+const ALARM_MESSAGE_VERSION = 2
+
+// Alarm payload. Fields are only ever added, receivers decoding an earlier
+// version ignore the ones they don't know
+type AlarmMessage struct {
+	Version   int    `json:",omitempty"` // ALARM_MESSAGE_VERSION
+	Id        string `json:",omitempty"` // unique id, unchanged across retries for idempotency
+	Module    string
+	TraceId   string
+	Key       string
+	Message   string
+	Severity  string            `json:",omitempty"` // level of the log message
+	Timestamp time.Time         `json:",omitzero"`  // time the alarm was raised
+	Hostname  string            `json:",omitempty"`
+	Pid       int               `json:",omitempty"`
+	Caller    string            `json:",omitempty"` // file:line of the logging call
+	Labels    map[string]string `json:",omitempty"` // labels of the LogWriter
+	Count     int               `json:",omitempty"` // occurrences represented, set when deduplicating
+	FirstSeen time.Time         `json:",omitzero"`  // first occurrence, set when deduplicating
+	LastSeen  time.Time         `json:",omitzero"`  // last occurrence, set when deduplicating
+	template  string            // message before formatting, used to identify repeats
+}
+
+var alarmHostname = sync.OnceValue(func() string {
+	hostname, _ := os.Hostname()
+	return hostname
+})
+
+// random alarm id
+func newAlarmId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type AlarmOptions struct {
+	QueueSize  int           // alarms buffered for delivery. Defaults to ALARM_QUEUE_SIZE
+	MaxRetries int           // retries after the first attempt, -1 for none. Defaults to ALARM_MAX_RETRIES
+	MinBackoff time.Duration // delay before the first retry, doubled per retry. Defaults to ALARM_MIN_BACKOFF
+	MaxBackoff time.Duration // maximum delay between retries. Defaults to ALARM_MAX_BACKOFF
+	Timeout    time.Duration // timeout of a single request. Defaults to ALARM_REQUEST_TIMEOUT
+	OutboxPath string        // file holding undelivered alarms for replay, empty to drop them
+
+	// Repeats of an alarm with the same module, key and message template
+	// within DedupWindow are coalesced: the first is sent at once and the
+	// repeats are reported by a single alarm carrying their count and first
+	// and last times at the end of the window. 0 disables deduplication
+	DedupWindow time.Duration
+	RateLimit   float64       // requests per second to the endpoint, 0 for no limit
+	RateBurst   int           // requests allowed in a burst above RateLimit. Defaults to 1
+	BatchSize   int           // alarms per request, sent as a JSON array when greater than 1
+	BatchDelay  time.Duration // maximum time an alarm waits for a batch to fill. Defaults to ALARM_BATCH_DELAY
+
+	// Formatter renders request bodies, AlarmMessage JSON if nil. Args are
+	// the arguments of the command of an exec: endpoint
+	Formatter AlarmFormatter
+	Args      []string
+}
+
+// Alarm delivery counters
+type AlarmCounts struct {
+	Delivered  uint64 // alarms accepted by the endpoint
+	Failed     uint64 // alarms that could not be delivered after all retries
+	Retried    uint64 // retried requests
+	Dropped    uint64 // alarms discarded because the queue was full and there is no outbox
+	Persisted  uint64 // alarms written to the outbox
+	Suppressed uint64 // repeats coalesced by deduplication
+}
+
+// Delivers alarms to an HTTP endpoint from a background goroutine. Callers
+// never block: when the queue is full alarms go to the outbox, or are dropped
+// if there is none. Requests failing or answered with a non-2xx status are
+// retried with exponential backoff and jitter. Alarms still undelivered are
+// appended to the outbox and replayed once the endpoint recovers, or when an
+// AlarmLogger is next started with the same outbox. Deduplication, rate
+// limiting and batching are applied by the delivery goroutine
+type AlarmLogger struct {
+	endpoint   string
+	command    string // exec hook run instead of POSTing to the endpoint
+	opts       AlarmOptions
+	client     *http.Client
+	cMsg       chan AlarmMessage // channel used to communicate messages to remote server
+	cStop      chan bool         // stop channel
+	done       chan bool
+	ctx        context.Context // cancels requests in flight on stop
+	cancel     context.CancelFunc
+	mu         sync.RWMutex // guards stopped
+	stopped    bool
+	outboxMu   sync.Mutex  // guards the outbox file
+	pending    atomic.Bool // outbox holds alarms
+	delivered  atomic.Uint64
+	failed     atomic.Uint64
+	retried    atomic.Uint64
+	dropped    atomic.Uint64
+	persisted  atomic.Uint64
+	suppressed atomic.Uint64
+
+	// owned by the delivery goroutine
+	repeats    map[string]*alarmRepeat // alarms seen within the dedup window
+	batch      []AlarmMessage          // alarms waiting for the batch to fill
+	batchTimer *time.Timer
+	limiter    *rateLimiter
+}
+
+// repeats of an alarm within the dedup window
+type alarmRepeat struct {
+	last    AlarmMessage // most recent repeat
+	count   int
+	first   time.Time
+	expires time.Time
+}
+
+// token bucket limiting the request rate
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Create an alarm logger and start delivering in the background
+func NewAlarmLogger(endpoint string, opts AlarmOptions) (*AlarmLogger, error) {
+	// http(s)://host/path, or exec:command to run a local hook
+	var command string
+	u, err := url.Parse(endpoint)
+	if err == nil && u.Scheme == "exec" {
+		if command = u.Opaque; command == "" {
+			command = u.Path
+		}
+	}
+	if err != nil || (command == "" && ((u.Scheme != "http" && u.Scheme != "https") || u.Host == "")) {
+		return nil, fmt.Errorf("Invalid alarm endpoint %s", endpoint)
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = ALARM_QUEUE_SIZE
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = ALARM_MAX_RETRIES
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = ALARM_MIN_BACKOFF
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = ALARM_MAX_BACKOFF
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = ALARM_REQUEST_TIMEOUT
+	}
+	if opts.DedupWindow < 0 || opts.RateLimit < 0 || opts.RateBurst < 0 || opts.BatchSize < 0 {
+		return nil, fmt.Errorf("Invalid alarm options")
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 1
+	}
+	if opts.BatchDelay <= 0 {
+		opts.BatchDelay = ALARM_BATCH_DELAY
+	}
+	if opts.RateBurst == 0 {
+		opts.RateBurst = 1
+	}
+	if opts.Formatter == nil {
+		opts.Formatter = jsonAlarmFormatter{array: opts.BatchSize > 1}
+	}
+
+	al := &AlarmLogger{endpoint: endpoint, command: command, opts: opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		cMsg:   make(chan AlarmMessage, opts.QueueSize),
+		cStop:  make(chan bool),
+		done:   make(chan bool),
+	}
+	if opts.DedupWindow > 0 {
+		al.repeats = make(map[string]*alarmRepeat)
+	}
+	if opts.RateLimit > 0 {
+		al.limiter = &rateLimiter{rate: opts.RateLimit, burst: float64(opts.RateBurst),
+			tokens: float64(opts.RateBurst), last: time.Now()}
+	}
+	al.ctx, al.cancel = context.WithCancel(context.Background())
+	if opts.OutboxPath != "" {
+		if fi, err := os.Stat(opts.OutboxPath); err == nil && fi.Size() > 0 {
+			al.pending.Store(true)
+		}
+	}
+	go al.run()
+	return al, nil
+}
+
+// Queue an alarm for delivery without blocking
+func (al *AlarmLogger) Send(msg AlarmMessage) {
+	if msg.Version == 0 {
+		msg.Version = ALARM_MESSAGE_VERSION
+	}
+	if msg.Id == "" {
+		msg.Id = newAlarmId()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	if !al.stopped {
+		select {
+		case al.cMsg <- msg:
+			return
+		default:
+		}
+	}
+	if al.persist(msg) != nil {
+		al.dropped.Add(1)
+	}
+}
+
+// Stop delivering. Queued alarms are moved to the outbox, or dropped if there is none
+func (al *AlarmLogger) Stop() {
+	al.mu.Lock()
+	if al.stopped {
+		al.mu.Unlock()
+		return
+	}
+	al.stopped = true
+	close(al.cStop)
+	al.cancel()
+	al.mu.Unlock()
+	<-al.done
+}
+
+func (al *AlarmLogger) Endpoint() string {
+	return al.endpoint
+}
+
+func (al *AlarmLogger) Counts() AlarmCounts {
+	return AlarmCounts{
+		Delivered:  al.delivered.Load(),
+		Failed:     al.failed.Load(),
+		Retried:    al.retried.Load(),
+		Dropped:    al.dropped.Load(),
+		Persisted:  al.persisted.Load(),
+		Suppressed: al.suppressed.Load(),
+	}
+}
+
+// append an alarm to the outbox
+func (al *AlarmLogger) persist(msg AlarmMessage) error {
+	if al.opts.OutboxPath == "" {
+		return fmt.Errorf("No alarm outbox")
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	al.outboxMu.Lock()
+	defer al.outboxMu.Unlock()
+	fp, err := os.OpenFile(al.opts.OutboxPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if _, err = fp.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	al.pending.Store(true)
+	al.persisted.Add(1)
+	return nil
+}
+
+// take the alarms out of the outbox
+func (al *AlarmLogger) takeOutbox() []AlarmMessage {
+	al.outboxMu.Lock()
+	defer al.outboxMu.Unlock()
+	al.pending.Store(false)
+
+	fp, err := os.Open(al.opts.OutboxPath)
+	if err != nil {
+		return nil
+	}
+	defer fp.Close()
+
+	var msgs []AlarmMessage
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var msg AlarmMessage
+		// skip lines torn by a crash while writing
+		if json.Unmarshal(scanner.Bytes(), &msg) == nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	os.Remove(al.opts.OutboxPath)
+	return msgs
+}
+
+// deliver the outbox. The remainder goes back to the outbox on the first failure
+func (al *AlarmLogger) replayOutbox() {
+	msgs := al.takeOutbox()
+	for len(msgs) > 0 {
+		n := min(len(msgs), al.opts.BatchSize)
+		if !al.deliver(msgs[:n]) {
+			for _, rest := range msgs[n:] {
+				if al.persist(rest) != nil {
+					al.dropped.Add(1)
+				}
+			}
+			return
+		}
+		msgs = msgs[n:]
+	}
+}
+
+// POST alarms rendered by the formatter, or run the exec hook. Non-2xx
+// responses are failures
+func (al *AlarmLogger) post(msgs []AlarmMessage) error {
+	reqBody, contentType, err := al.opts.Formatter.Format(msgs)
+	if err != nil {
+		return err
+	}
+	if al.command != "" {
+		return al.execute(reqBody, contentType, len(msgs))
+	}
+
+	r, err := http.NewRequestWithContext(al.ctx, "POST", al.endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", contentType)
+
+	resp, err := al.client.Do(r)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Alarm endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// delay before retry n, exponential with jitter in [d/2, d]
+func (al *AlarmLogger) backoff(n int) time.Duration {
+	d := al.opts.MinBackoff
+	for i := 0; i < n && d < al.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > al.opts.MaxBackoff {
+		d = al.opts.MaxBackoff
+	}
+	return d/2 + time.Duration(mrand.Int63n(int64(d/2)+1))
+}
+
+// wait for the rate limiter. Returns false if stopped while waiting
+func (al *AlarmLogger) throttle() bool {
+	if al.limiter == nil {
+		return true
+	}
+	d := al.limiter.reserve(time.Now())
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-al.cStop:
+		return false
+	}
+}
+
+// take a token, returning how long to wait before it is available
+func (rl *rateLimiter) reserve(now time.Time) time.Duration {
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+	rl.tokens--
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+// deliver alarms in one request with retries. Undelivered alarms are moved to the outbox
+func (al *AlarmLogger) deliver(msgs []AlarmMessage) bool {
+	var err error
+retry:
+	for n := 0; ; n++ {
+		if !al.throttle() {
+			err = fmt.Errorf("Alarm logger stopped")
+			break
+		}
+		if err = al.post(msgs); err == nil {
+			al.delivered.Add(uint64(len(msgs)))
+			return true
+		}
+		if n == al.opts.MaxRetries {
+			break
+		}
+
+		timer := time.NewTimer(al.backoff(n))
+		select {
+		case <-timer.C:
+			al.retried.Add(1)
+		case <-al.cStop:
+			// stopping, leave the alarms to the outbox
+			timer.Stop()
+			break retry
+		}
+	}
+
+	al.failed.Add(uint64(len(msgs)))
+	for _, msg := range msgs {
+		if al.persist(msg) != nil {
+			fmt.Printf("Logger: Unable to deliver alarm to %s, Error %s\n", al.endpoint, err.Error())
+		}
+	}
+	return false
+}
+
+// identity of an alarm for deduplication
+func repeatKey(msg AlarmMessage) string {
+	template := msg.template
+	if template == "" {
+		template = msg.Message
+	}
+	return msg.Module + "\x00" + msg.Key + "\x00" + template
+}
+
+// apply the dedup window. Returns false if the alarm is a repeat to be coalesced
+func (al *AlarmLogger) coalesce(msg *AlarmMessage) bool {
+	if al.repeats == nil {
+		return true
+	}
+
+	key := repeatKey(*msg)
+	if r, ok := al.repeats[key]; ok && msg.Timestamp.Before(r.expires) {
+		if r.count == 0 {
+			r.first = msg.Timestamp
+		}
+		r.count++
+		r.last = *msg
+		al.suppressed.Add(1)
+		return false
+	}
+
+	al.repeats[key] = &alarmRepeat{expires: msg.Timestamp.Add(al.opts.DedupWindow)}
+	msg.Count, msg.FirstSeen, msg.LastSeen = 1, msg.Timestamp, msg.Timestamp
+	return true
+}
+
+// summarise the repeats of expired dedup windows. A window with repeats is
+// renewed so that a sustained burst is reported once per window
+func (al *AlarmLogger) expireRepeats(now time.Time, all bool) []AlarmMessage {
+	var summaries []AlarmMessage
+	for key, r := range al.repeats {
+		if !all && now.Before(r.expires) {
+			continue
+		}
+		if r.count == 0 {
+			delete(al.repeats, key)
+			continue
+		}
+		// a new alarm, not a retry of the last repeat
+		msg := r.last
+		msg.Id, msg.Timestamp = newAlarmId(), now
+		msg.Count, msg.FirstSeen, msg.LastSeen = r.count, r.first, r.last.Timestamp
+		summaries = append(summaries, msg)
+		r.count = 0
+		r.expires = now.Add(al.opts.DedupWindow)
+	}
+	return summaries
+}
+
+// add an alarm to the batch, sending the batch once full
+func (al *AlarmLogger) add(msg AlarmMessage) {
+	al.batch = append(al.batch, msg)
+	if len(al.batch) >= al.opts.BatchSize {
+		al.flush()
+	} else if al.batchTimer == nil {
+		al.batchTimer = time.NewTimer(al.opts.BatchDelay)
+	}
+}
+
+// send the pending batch
+func (al *AlarmLogger) flush() {
+	if al.batchTimer != nil {
+		al.batchTimer.Stop()
+		al.batchTimer = nil
+	}
+	if len(al.batch) == 0 {
+		return
+	}
+	msgs := al.batch
+	al.batch = nil
+	if al.deliver(msgs) && al.pending.Load() {
+		al.replayOutbox()
+	}
+}
+
+// move pending alarms to the outbox on stop
+func (al *AlarmLogger) persistPending() {
+	pending := append(al.batch, al.expireRepeats(time.Now(), true)...)
+	al.batch = nil
+	for {
+		select {
+		case msg := <-al.cMsg:
+			pending = append(pending, msg)
+		default:
+			for _, msg := range pending {
+				if al.persist(msg) != nil {
+					al.dropped.Add(1)
+				}
+			}
+			return
+		}
+	}
+}
+
+// delivery goroutine
+func (al *AlarmLogger) run() {
+	defer close(al.done)
+
+	ticker := time.NewTicker(al.opts.MaxBackoff)
+	defer ticker.Stop()
+
+	var sweep <-chan time.Time
+	if al.repeats != nil {
+		sweeper := time.NewTicker(max(al.opts.DedupWindow/4, time.Millisecond))
+		defer sweeper.Stop()
+		sweep = sweeper.C
+	}
+
+	if al.pending.Load() {
+		al.replayOutbox()
+	}
+	for {
+		var batchC <-chan time.Time
+		if al.batchTimer != nil {
+			batchC = al.batchTimer.C
+		}
+
+		select {
+		case msg := <-al.cMsg:
+			if al.coalesce(&msg) {
+				al.add(msg)
+			}
+		case now := <-sweep:
+			for _, msg := range al.expireRepeats(now, false) {
+				al.add(msg)
+			}
+		case <-batchC:
+			al.flush()
+		case <-ticker.C:
+			if al.pending.Load() {
+				al.replayOutbox()
+			}
+		case <-al.cStop:
+			al.persistPending()
+			return
+		}
+	}
+}
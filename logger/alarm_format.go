@@ -0,0 +1,179 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// An AlarmFormatter renders the alarms of one delivery request as the request
+// body, returning the body and its content type. Without a formatter alarms
+// are sent as AlarmMessage JSON, an array when batching
+type AlarmFormatter interface {
+	Format(msgs []AlarmMessage) ([]byte, string, error)
+}
+
+// default AlarmMessage JSON
+type jsonAlarmFormatter struct {
+	array bool
+}
+
+func (f jsonAlarmFormatter) Format(msgs []AlarmMessage) ([]byte, string, error) {
+	var body []byte
+	var err error
+	if f.array {
+		body, err = json.Marshal(msgs)
+	} else {
+		body, err = json.Marshal(msgs[0])
+	}
+	return body, "application/json", err
+}
+
+// Formats alarms for the Alertmanager v2 API (POST /api/v2/alerts)
+type AlertmanagerFormatter struct {
+	GeneratorURL string // link back to the source of the alerts, optional
+}
+
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     string            `json:"startsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// Each alarm becomes an alert named after its key. Module, severity, host and
+// the LogWriter labels are alert labels, the message and origin annotations
+func (f AlertmanagerFormatter) Format(msgs []AlarmMessage) ([]byte, string, error) {
+	alerts := make([]alertmanagerAlert, 0, len(msgs))
+	for _, msg := range msgs {
+		labels := make(map[string]string, len(msg.Labels)+4)
+		for k, v := range msg.Labels {
+			labels[k] = v
+		}
+		labels["alertname"] = msg.Key
+		labels["module"] = msg.Module
+		if msg.Severity != "" {
+			labels["severity"] = msg.Severity
+		}
+		if msg.Hostname != "" {
+			labels["instance"] = msg.Hostname
+		}
+
+		annotations := map[string]string{"summary": msg.Message}
+		if msg.TraceId != "" {
+			annotations["traceId"] = msg.TraceId
+		}
+		if msg.Caller != "" {
+			annotations["caller"] = msg.Caller
+		}
+		if msg.Id != "" {
+			annotations["alarmId"] = msg.Id
+		}
+		if msg.Pid != 0 {
+			annotations["pid"] = strconv.Itoa(msg.Pid)
+		}
+		if msg.Count > 1 {
+			annotations["count"] = strconv.Itoa(msg.Count)
+		}
+
+		startsAt := msg.FirstSeen
+		if startsAt.IsZero() {
+			startsAt = msg.Timestamp
+		}
+		alert := alertmanagerAlert{Labels: labels, Annotations: annotations, GeneratorURL: f.GeneratorURL}
+		if !startsAt.IsZero() {
+			alert.StartsAt = startsAt.UTC().Format(time.RFC3339Nano)
+		}
+		alerts = append(alerts, alert)
+	}
+
+	body, err := json.Marshal(alerts)
+	return body, "application/json", err
+}
+
+// Data passed to the template of a TemplateFormatter
+type AlarmTemplateData struct {
+	Alarms []AlarmMessage // alarms of the request, one unless batching
+}
+
+// Formats alarms with a text/template, for webhooks expecting their own body
+// e.g. chat integrations. The template is executed with AlarmTemplateData and
+// has a json function to quote values
+type TemplateFormatter struct {
+	tmpl        *template.Template
+	contentType string
+}
+
+// Parse a webhook template. contentType defaults to application/json
+func NewTemplateFormatter(text string, contentType string) (*TemplateFormatter, error) {
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}
+	tmpl, err := template.New("alarm").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid alarm template %s", err.Error())
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return &TemplateFormatter{tmpl: tmpl, contentType: contentType}, nil
+}
+
+func (f *TemplateFormatter) Format(msgs []AlarmMessage) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if err := f.tmpl.Execute(&buf, AlarmTemplateData{Alarms: msgs}); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), f.contentType, nil
+}
+
+// formatter selected by name in socket requests
+func alarmFormatter(format string, text string) (AlarmFormatter, error) {
+	switch strings.ToLower(format) {
+	case "", "json":
+		return nil, nil
+	case "alertmanager":
+		return AlertmanagerFormatter{}, nil
+	case "template":
+		return NewTemplateFormatter(text, "")
+	}
+	return nil, fmt.Errorf("Unknown alarm format %s", format)
+}
+
+// run the exec hook of the target with the formatted alarms on stdin. A
+// non-zero exit status is a failed delivery
+func (al *AlarmLogger) execute(body []byte, contentType string, count int) error {
+	ctx, cancel := context.WithTimeout(al.ctx, al.opts.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, al.command, al.opts.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), "ALARM_CONTENT_TYPE="+contentType, "ALARM_COUNT="+strconv.Itoa(count))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(output) > 256 {
+			output = output[:256]
+		}
+		return fmt.Errorf("Alarm command %s failed %s %s", al.command, err.Error(),
+			strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Routing rule of an alarm target. The zero value alarms on every error
+type AlarmRule struct {
+	MinLevel    LogLevel // least severe level alarmed
+	Keys        []string // keys alarmed, all keys if empty
+	ExcludeKeys []string // keys never alarmed
+	Match       string   // regular expression the message must match, any message if empty
+}
+
+// Description of an alarm target, used by the socket protocol to add and list targets
+type AlarmTargetInfo struct {
+	Name        string `json:",omitempty"` // defaults to AlarmTargetName of the endpoint
+	Endpoint    string
+	Level       string       `json:",omitempty"` // minimum level, error if empty
+	Keys        []string     `json:",omitempty"`
+	ExcludeKeys []string     `json:",omitempty"`
+	Match       string       `json:",omitempty"`
+	Format      string       `json:",omitempty"` // json, alertmanager or template
+	Template    string       `json:",omitempty"` // text/template of the template format
+	Counts      *AlarmCounts `json:",omitempty"` // delivery counters, when listing
+}
+
+type alarmTarget struct {
+	name   string
+	rule   AlarmRule
+	match  *regexp.Regexp
+	format string // formatter name, for listing
+	al     *AlarmLogger
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// check an alarm against the routing rule of the target
+func (at *alarmTarget) accepts(level LogLevel, key string, message string) bool {
+	if level > at.rule.MinLevel {
+		return false
+	}
+	if len(at.rule.Keys) > 0 && !containsKey(at.rule.Keys, key) {
+		return false
+	}
+	if containsKey(at.rule.ExcludeKeys, key) {
+		return false
+	}
+	return at.match == nil || at.match.MatchString(message)
+}
+
+// check if a message at level may raise an alarm on any target
+func (lw *LogWriter) alarmWanted(level LogLevel) bool {
+	return lw.alarmEnabled.Load() == true && level <= LogLevel(lw.alarmLevel.Load())
+}
+
+// send alarm to the remote targets whose rules accept it. Fields are appended
+// to the message. Repeats are identified by the message template, before
+// arguments and fields are applied
+func (lw *LogWriter) raiseAlarm(level LogLevel, traceId string, key string, template string, message string,
+	caller string, fields ...Field) {
+	if len(fields) > 0 {
+		message = message + " " + renderFields(FieldFormat(lw.fieldFormat.Load()), fields)
+	}
+
+	lw.alarmMu.RLock()
+	defer lw.alarmMu.RUnlock()
+
+	var msg *AlarmMessage
+	for _, at := range lw.alarmTargets {
+		if !at.accepts(level, key, message) {
+			continue
+		}
+		if msg == nil {
+			msg = &AlarmMessage{
+				Module:    lw.module,
+				TraceId:   traceId,
+				Key:       key,
+				Message:   message,
+				Severity:  level.String(),
+				Timestamp: time.Now(),
+				Hostname:  alarmHostname(),
+				Pid:       os.Getpid(),
+				Caller:    caller,
+				Labels:    lw.alarmLabels,
+				template:  template,
+			}
+		}
+		at.al.Send(*msg)
+	}
+}
+
+// Set labels sent with every alarm, e.g. cluster or service names
+func (lw *LogWriter) SetAlarmLabels(labels map[string]string) {
+	var copied map[string]string
+	if len(labels) > 0 {
+		copied = make(map[string]string, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+	}
+	lw.alarmMu.Lock()
+	lw.alarmLabels = copied
+	lw.alarmMu.Unlock()
+}
+
+// register alarm endpoint. Any error log will be sent to this remote endpoint
+func (lw *LogWriter) RegisterAlarm(endpoint string) error {
+	return lw.RegisterAlarmOptions(endpoint, AlarmOptions{})
+}
+
+// register alarm endpoint with delivery options. The target is named after
+// the endpoint, registering it again replaces it
+func (lw *LogWriter) RegisterAlarmOptions(endpoint string, opts AlarmOptions) error {
+	return lw.AddAlarmTarget(AlarmTargetName(endpoint), endpoint, AlarmRule{}, opts)
+}
+
+// Name of a target added without one, e.g. target-1a2b3c4d. Unlike the
+// endpoint it can be used in a URL path
+func AlarmTargetName(endpoint string) string {
+	sum := sha256.Sum256([]byte(endpoint))
+	return "target-" + hex.EncodeToString(sum[:4])
+}
+
+// Add an alarm target, replacing any target of the same name. Alarms are
+// sent to every target whose rule accepts them
+func (lw *LogWriter) AddAlarmTarget(name string, endpoint string, rule AlarmRule, opts AlarmOptions) error {
+	if name == "" {
+		return fmt.Errorf("Required alarm target name")
+	}
+	if rule.MinLevel > LevelDebug || rule.MinLevel < LevelError {
+		return fmt.Errorf("Invalid alarm level")
+	}
+	at := &alarmTarget{name: name, rule: rule}
+	at.rule.Keys = append([]string(nil), rule.Keys...)
+	at.rule.ExcludeKeys = append([]string(nil), rule.ExcludeKeys...)
+	if rule.Match != "" {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("Invalid alarm match %s", err.Error())
+		}
+		at.match = re
+	}
+
+	al, err := NewAlarmLogger(endpoint, opts)
+	if err != nil {
+		return err
+	}
+	at.al = al
+	switch opts.Formatter.(type) {
+	case nil:
+	case AlertmanagerFormatter, *AlertmanagerFormatter:
+		at.format = "alertmanager"
+	case *TemplateFormatter:
+		at.format = "template"
+	default:
+		at.format = "custom"
+	}
+
+	lw.alarmMu.Lock()
+	var old *AlarmLogger
+	targets := make([]*alarmTarget, 0, len(lw.alarmTargets)+1)
+	for _, t := range lw.alarmTargets {
+		if t.name == name {
+			old = t.al
+			continue
+		}
+		targets = append(targets, t)
+	}
+	lw.setAlarmTargets(append(targets, at))
+	lw.alarmMu.Unlock()
+
+	if old != nil {
+		old.Stop()
+	}
+	return nil
+}
+
+// Remove and stop an alarm target. A target named after its endpoint may also
+// be given by the endpoint
+func (lw *LogWriter) RemoveAlarmTarget(name string) error {
+	lw.alarmMu.Lock()
+	var old *AlarmLogger
+	targets := make([]*alarmTarget, 0, len(lw.alarmTargets))
+	for _, t := range lw.alarmTargets {
+		if t.name == name || (t.name == AlarmTargetName(name) && t.al.Endpoint() == name) {
+			old = t.al
+			continue
+		}
+		targets = append(targets, t)
+	}
+	if old != nil {
+		lw.setAlarmTargets(targets)
+	}
+	lw.alarmMu.Unlock()
+
+	if old == nil {
+		return fmt.Errorf("Alarm target %s not found", name)
+	}
+	old.Stop()
+	return nil
+}
+
+// Remove and stop all alarm targets
+func (lw *LogWriter) ClearAlarm() {
+	lw.alarmMu.Lock()
+	targets := lw.alarmTargets
+	lw.setAlarmTargets(nil)
+	lw.alarmMu.Unlock()
+
+	for _, at := range targets {
+		at.al.Stop()
+	}
+}
+
+// install a new target list. Called with alarmMu held
+func (lw *LogWriter) setAlarmTargets(targets []*alarmTarget) {
+	level := LevelError
+	for _, at := range targets {
+		if at.rule.MinLevel > level {
+			level = at.rule.MinLevel
+		}
+	}
+	lw.alarmTargets = targets
+	lw.alarmLevel.Store(int32(level))
+	lw.alarmEnabled.Store(len(targets) > 0)
+}
+
+// Describe the alarm targets with their delivery counters
+func (lw *LogWriter) AlarmTargets() []AlarmTargetInfo {
+	lw.alarmMu.RLock()
+	defer lw.alarmMu.RUnlock()
+
+	infos := make([]AlarmTargetInfo, 0, len(lw.alarmTargets))
+	for _, at := range lw.alarmTargets {
+		counts := at.al.Counts()
+		infos = append(infos, AlarmTargetInfo{
+			Name:        at.name,
+			Endpoint:    at.al.Endpoint(),
+			Level:       at.rule.MinLevel.String(),
+			Keys:        at.rule.Keys,
+			ExcludeKeys: at.rule.ExcludeKeys,
+			Match:       at.rule.Match,
+			Format:      at.format,
+			Counts:      &counts,
+		})
+	}
+	return infos
+}
+
+// Delivery counters summed over the alarm targets
+func (lw *LogWriter) AlarmCounts() AlarmCounts {
+	lw.alarmMu.RLock()
+	defer lw.alarmMu.RUnlock()
+
+	var total AlarmCounts
+	for _, at := range lw.alarmTargets {
+		counts := at.al.Counts()
+		total.Delivered += counts.Delivered
+		total.Failed += counts.Failed
+		total.Retried += counts.Retried
+		total.Dropped += counts.Dropped
+		total.Persisted += counts.Persisted
+		total.Suppressed += counts.Suppressed
+	}
+	return total
+}
+
+// add a target from a socket request, either an endpoint or an
+// AlarmTargetInfo JSON object. Exec hooks run commands on the host and can
+// only be registered by the process itself
+func setAlarm(lw *LogWriter, request string) error {
+	var info AlarmTargetInfo
+	request = strings.TrimSpace(request)
+	if !strings.HasPrefix(request, "{") {
+		info.Endpoint = request
+	} else if err := json.Unmarshal([]byte(request), &info); err != nil {
+		return fmt.Errorf("Invalid alarm target %s", err.Error())
+	}
+	if !strings.HasPrefix(info.Endpoint, "http://") && !strings.HasPrefix(info.Endpoint, "https://") {
+		return fmt.Errorf("Invalid alarm endpoint %s", info.Endpoint)
+	}
+
+	formatter, err := alarmFormatter(info.Format, info.Template)
+	if err != nil {
+		return err
+	}
+	rule := AlarmRule{Keys: info.Keys, ExcludeKeys: info.ExcludeKeys, Match: info.Match}
+	if info.Level != "" {
+		level, err := ParseLogLevel(info.Level)
+		if err != nil {
+			return err
+		}
+		rule.MinLevel = level
+	}
+	name := info.Name
+	if name == "" {
+		name = AlarmTargetName(info.Endpoint)
+	}
+	return lw.AddAlarmTarget(name, info.Endpoint, rule, AlarmOptions{Formatter: formatter})
+}
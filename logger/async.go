@@ -0,0 +1,232 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"fmt"
+	"github.com/couchbase/retriever/stats"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const DEFAULT_ASYNC_QUEUE_SIZE = 4096
+
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // block the caller until there is room
+	OverflowDropNewest                       // discard the message being logged
+	OverflowDropOldest                       // discard the oldest queued message
+)
+
+type AsyncOptions struct {
+	QueueSize int            // capacity of the ring buffer. Defaults to DEFAULT_ASYNC_QUEUE_SIZE
+	Overflow  OverflowPolicy // behaviour when the queue is full
+}
+
+// bounded ring buffer of log entries drained by a single goroutine
+type asyncQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	drained  *sync.Cond
+	buf      []*Record
+	head     int
+	count    int
+	busy     bool // flusher is writing an entry taken off the queue
+	closed   bool
+	overflow OverflowPolicy
+	dropped  atomic.Uint64 // messages discarded on overflow
+	done     chan bool
+}
+
+func newAsyncQueue(opts AsyncOptions) *asyncQueue {
+	size := opts.QueueSize
+	if size <= 0 {
+		size = DEFAULT_ASYNC_QUEUE_SIZE
+	}
+	q := &asyncQueue{buf: make([]*Record, size), overflow: opts.Overflow, done: make(chan bool)}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	q.drained = sync.NewCond(&q.mu)
+	return q
+}
+
+// queue an entry. Returns false if the queue has been closed and the entry
+// should be written synchronously
+func (q *asyncQueue) put(entry *Record) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.count == len(q.buf) && !q.closed {
+		switch q.overflow {
+		case OverflowDropNewest:
+			q.dropped.Add(1)
+			return true
+		case OverflowDropOldest:
+			q.buf[q.head] = nil
+			q.head = (q.head + 1) % len(q.buf)
+			q.count--
+			q.dropped.Add(1)
+		default:
+			q.notFull.Wait()
+		}
+	}
+	if q.closed {
+		return false
+	}
+
+	q.buf[(q.head+q.count)%len(q.buf)] = entry
+	q.count++
+	q.notEmpty.Signal()
+	return true
+}
+
+// take the next entry off the queue. Returns nil once the queue is closed and empty
+func (q *asyncQueue) get() *Record {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.busy = false
+	for q.count == 0 {
+		q.drained.Broadcast()
+		if q.closed {
+			return nil
+		}
+		q.notEmpty.Wait()
+	}
+
+	entry := q.buf[q.head]
+	q.buf[q.head] = nil
+	q.head = (q.head + 1) % len(q.buf)
+	q.count--
+	q.busy = true
+	q.notFull.Signal()
+	return entry
+}
+
+// wait until everything queued so far has been written
+func (q *asyncQueue) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.count > 0 || q.busy {
+		q.drained.Wait()
+	}
+}
+
+func (q *asyncQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+	<-q.done
+}
+
+func asyncFlusher(lw *LogWriter, q *asyncQueue) {
+	defer close(q.done)
+	for {
+		entry := q.get()
+		if entry == nil {
+			return
+		}
+		lw.outputEntry(entry)
+	}
+}
+
+// Enable asynchronous logging. Messages are queued by the caller and written
+// by a single background goroutine
+func (lw *LogWriter) EnableAsync(opts AsyncOptions) error {
+	if opts.Overflow < OverflowBlock || opts.Overflow > OverflowDropOldest {
+		return fmt.Errorf("Invalid overflow policy")
+	}
+	lw.asyncMu.Lock()
+	defer lw.asyncMu.Unlock()
+	if lw.async.Load() != nil {
+		return fmt.Errorf("Async logging already enabled")
+	}
+
+	q := newAsyncQueue(opts)
+	go asyncFlusher(lw, q)
+	lw.async.Store(q)
+	return nil
+}
+
+// Wait for all queued messages to be written. No-op in synchronous mode
+func (lw *LogWriter) Flush() error {
+	if q := lw.async.Load(); q != nil {
+		q.flush()
+	}
+
+	lw.fileMu.RLock()
+	defer lw.fileMu.RUnlock()
+	if lw.file != nil {
+		return lw.file.Sync()
+	}
+	return nil
+}
+
+// Drain the async queue, stop the flusher and close the log file and sinks.
+// Later messages are logged synchronously to stderr
+func (lw *LogWriter) Close() error {
+	lw.asyncMu.Lock()
+	if q := lw.async.Load(); q != nil {
+		q.close()
+		lw.dropped.Add(q.dropped.Load())
+		lw.async.Store(nil)
+	}
+	lw.asyncMu.Unlock()
+
+	lw.closeSinks()
+
+	lw.fileMu.Lock()
+	defer lw.fileMu.Unlock()
+	var err error
+	if lw.file != nil {
+		err = lw.file.Close()
+		lw.file = nil
+		lw.logger = log.New(os.Stderr, "", lw.logFlags())
+	}
+	return err
+}
+
+// Number of messages discarded because the async queue was full
+func (lw *LogWriter) DroppedCount() uint64 {
+	dropped := lw.dropped.Load()
+	if q := lw.async.Load(); q != nil {
+		dropped += q.dropped.Load()
+	}
+	return dropped
+}
+
+// Number of messages waiting in the async queue
+func (lw *LogWriter) QueuedCount() int {
+	q := lw.async.Load()
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Publish the async writer and alarm counters through a stats collector as
+// log_<module>_dropped, log_<module>_queued and log_<module>_alarms
+func (lw *LogWriter) RegisterStats(sc *stats.StatsCollector) error {
+	prefix := "log_" + lw.module + "_"
+	if err := sc.AddStatFunc(prefix+"dropped", func() interface{} { return lw.DroppedCount() }); err != nil {
+		return err
+	}
+	if err := sc.AddStatFunc(prefix+"queued", func() interface{} { return lw.QueuedCount() }); err != nil {
+		return err
+	}
+	return sc.AddStatFunc(prefix+"alarms", func() interface{} { return lw.AlarmCounts() })
+}
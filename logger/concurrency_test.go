@@ -0,0 +1,229 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"fmt"
+	"github.com/couchbase/retriever/protocol"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// send a legacy text command as the server would and return the reply
+func runCommand(lw *LogWriter, cmds []string) string {
+	server, client := net.Pipe()
+	go func() {
+		protocol.Serve(server, func(req *protocol.Request) *protocol.Response {
+			return handleRequest(lw, req)
+		})
+		server.Close()
+	}()
+	client.Write([]byte(strings.Join(cmds, ":")))
+	reply, _ := io.ReadAll(client)
+	client.Close()
+	return string(reply)
+}
+
+// Exercise the LogWriter from logging goroutines while the controls are
+// changed concurrently. Run with go test -race
+func TestConcurrentLogging(t *testing.T) {
+
+	alarmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer alarmServer.Close()
+
+	mylog, err := NewLogger("testconcurrent", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	dir := t.TempDir()
+	mylog.SetDefaultPath(dir)
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	mylog.SetRotationPolicy(&RotationPolicy{MaxSize: 16 << 10, MaxFiles: 3})
+	mylog.EnableKeys([]string{"k0", "k1", "k2", "k3"})
+
+	const writers = 8
+	const messages = 500
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			key := fmt.Sprintf("k%d", id%4)
+			for n := 0; n < messages; n++ {
+				traceId := ""
+				if n%10 == 0 {
+					traceId = fmt.Sprintf("race%d", id)
+				}
+				switch n % 4 {
+				case 0:
+					mylog.LogDebug(traceId, key, "debug %d %d", id, n)
+				case 1:
+					mylog.LogInfoKV(traceId, key, "info", Int("writer", id), Int("n", n))
+				case 2:
+					mylog.LogWarn(traceId, key, "warn %d %d", id, n)
+				case 3:
+					mylog.LogError(traceId, key, "error %d %d", id, n)
+				}
+			}
+		}(i)
+	}
+
+	var cwg sync.WaitGroup
+	controls := []func(n int){
+		func(n int) { mylog.SetLogLevel(LogLevel(n % 4)) },
+		func(n int) { mylog.SetKeyLevel("k1", LogLevel(n%4)) },
+		func(n int) { mylog.EnableKeys([]string{"k4"}); mylog.DisableKeys([]string{"k4"}) },
+		func(n int) { mylog.SetColor(n%2 == 0) },
+		func(n int) { mylog.SetEncoder(Encoder(n % 2)) },
+		func(n int) { mylog.SetFieldFormat(FieldFormat(n % 2)) },
+		func(n int) {
+			if n%2 == 0 {
+				mylog.EnableTraceLogging()
+			} else {
+				mylog.DisableTraceLogging()
+			}
+		},
+		func(n int) {
+			if n%2 == 0 {
+				mylog.RegisterAlarm(alarmServer.URL)
+			} else {
+				mylog.ClearAlarm()
+			}
+		},
+		func(n int) { mylog.Rotate() },
+		func(n int) { runCommand(mylog, []string{"level", "warn,k2=debug"}) },
+		func(n int) { mylog.GetFilePath(); mylog.KeyLevels() },
+	}
+	for _, control := range controls {
+		cwg.Add(1)
+		go func(control func(int)) {
+			defer cwg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				control(n)
+				time.Sleep(time.Millisecond)
+			}
+		}(control)
+	}
+
+	wg.Wait()
+	close(stop)
+	cwg.Wait()
+	mylog.ClearAlarm()
+	mylog.DisableTraceLogging()
+
+	if err = mylog.Close(); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+}
+
+// Async mode with concurrent producers, flushes and a final close
+func TestConcurrentAsync(t *testing.T) {
+
+	mylog, err := NewLogger("testconcurrentasync", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	mylog.SetDefaultPath(t.TempDir())
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.EnableAsync(AsyncOptions{QueueSize: 64, Overflow: OverflowDropOldest}); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for n := 0; n < 500; n++ {
+				mylog.LogWarn("", "", "async %d %d", id, n)
+				if n%100 == 0 {
+					mylog.Flush()
+					mylog.DroppedCount()
+					mylog.QueuedCount()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err = mylog.Close(); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+	// logging after close falls back to stderr
+	mylog.LogWarn("", "", "after close")
+}
+
+// framed requests as sent by the retriever server
+func TestControlProtocol(t *testing.T) {
+
+	mylog, err := NewLogger("testprotocol", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	call := func(req *protocol.Request) *protocol.Response {
+		server, client := net.Pipe()
+		defer client.Close()
+		go func() {
+			protocol.Serve(server, func(req *protocol.Request) *protocol.Response {
+				return handleRequest(mylog, req)
+			})
+			server.Close()
+		}()
+		resp, err := protocol.Call(client, req)
+		if err != nil {
+			t.Fatalf("Failed ! Error %s", err.Error())
+		}
+		if resp.Body != nil {
+			io.ReadAll(resp.Body)
+		}
+		return resp
+	}
+
+	if resp := call(protocol.NewRequest("level", "warn,DCP=debug")); resp.Status != protocol.StatusOK {
+		t.Errorf("Failed ! level %+v", resp)
+	}
+	if mylog.GetLogLevel() != LevelWarn || mylog.KeyLevels()["DCP"] != LevelDebug {
+		t.Errorf("Failed ! levels not applied")
+	}
+	if resp := call(protocol.NewRequest("level", "loud")); resp.Status != protocol.StatusBadRequest {
+		t.Errorf("Failed ! expected bad request %+v", resp)
+	}
+	// framed commands match exactly
+	if resp := call(protocol.NewRequest("traceDisable")); resp.Status != protocol.StatusNotFound {
+		t.Errorf("Failed ! expected unknown command %+v", resp)
+	}
+	if resp := call(protocol.NewRequest("alarmlist")); resp.Status != protocol.StatusOK || string(resp.Data) != "[]" {
+		t.Errorf("Failed ! alarmlist %+v", resp)
+	}
+
+	// legacy text commands are still accepted
+	if reply := runCommand(mylog, []string{"traceoff", ""}); reply != "OK" {
+		t.Errorf("Failed ! legacy reply %s", reply)
+	}
+}
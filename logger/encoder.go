@@ -0,0 +1,230 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Encoder int
+
+const (
+	EncoderText Encoder = iota // "<key> <traceId|None> <message>" with timestamp prefix
+	EncoderJSON                // one JSON object per line
+)
+
+// A single log record, as handed to the encoders and sinks
+type Record struct {
+	Time    time.Time
+	Level   LogLevel
+	Module  string
+	Key     string
+	TraceId string
+	Message string
+	Fields  []Field
+	Caller  string // file:line, only set when encoding JSON
+}
+
+func (level LogLevel) String() string {
+	switch level {
+	case LevelError:
+		return "error"
+	case LevelWarn:
+		return "warn"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	case LevelGlobal:
+		return "global"
+	}
+	return "unknown"
+}
+
+// colour used for a level in text mode
+func levelColor(level LogLevel) string {
+	switch level {
+	case LevelError:
+		return fgRed
+	case LevelWarn:
+		return fgYellow
+	case LevelInfo:
+		return fgBlue
+	}
+	return fgWhite
+}
+
+// return file:line of the caller skip frames above the caller of getCaller
+func getCaller(skip int) string {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	return filepath.Base(file) + ":" + strconv.Itoa(line)
+}
+
+// encode an entry in the text format. The timestamp is prefixed by log.Logger
+func encodeText(e *Record, color string, fieldFormat FieldFormat) string {
+	message := e.Message
+	if len(e.Fields) > 0 {
+		message = message + " " + renderFields(fieldFormat, e.Fields)
+	}
+
+	// color formatting doesn't work on windows.
+	if runtime.GOOS == "windows" {
+		if e.TraceId != "" {
+			return fmt.Sprintf("%s %s %s", e.Key, e.TraceId, message)
+		}
+		return fmt.Sprintf("%s None %s", e.Key, message)
+	}
+	if e.TraceId != "" {
+		return fmt.Sprintf("%s %s %s", color+e.Key, reset+e.TraceId, message)
+	}
+	return fmt.Sprintf("%s None %s", color+e.Key, reset+message)
+}
+
+// encode an entry as a single line JSON object
+func encodeJSON(e *Record) string {
+	var buf bytes.Buffer
+
+	writeString := func(name string, value string) {
+		v, _ := json.Marshal(value)
+		buf.WriteString(`"` + name + `":`)
+		buf.Write(v)
+	}
+
+	buf.WriteByte('{')
+	writeString("timestamp", e.Time.Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeString("level", e.Level.String())
+	buf.WriteByte(',')
+	writeString("module", e.Module)
+	buf.WriteByte(',')
+	writeString("key", e.Key)
+	buf.WriteByte(',')
+	writeString("traceId", e.TraceId)
+	buf.WriteByte(',')
+	writeString("message", e.Message)
+	if e.Caller != "" {
+		buf.WriteByte(',')
+		writeString("caller", e.Caller)
+	}
+	if len(e.Fields) > 0 {
+		buf.WriteString(`,"fields":`)
+		buf.WriteString(fieldsJSON(e.Fields))
+	}
+	buf.WriteByte('}')
+
+	return buf.String()
+}
+
+// Level, key and trace id of a line read back from a log or trace file
+type LineInfo struct {
+	Level   LogLevel // LevelGlobal when the line does not carry its level
+	Key     string
+	TraceId string
+	Text    string // the line without colour codes
+}
+
+// level shown by a colour code of the text format
+func colorLevel(code string) LogLevel {
+	switch code {
+	case fgRed:
+		return LevelError
+	case fgYellow:
+		return LevelWarn
+	case fgBlue:
+		return LevelInfo
+	case fgWhite:
+		return LevelDebug
+	}
+	return LevelGlobal
+}
+
+// Parse a line written in the text or JSON format. Text lines carry their
+// level as a colour only, so lines logged without colour have no level.
+// Continuation lines of multi-line messages have no key
+func ParseLine(line string) LineInfo {
+	info := LineInfo{Level: LevelGlobal, Text: line}
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Level   string `json:"level"`
+			Key     string `json:"key"`
+			TraceId string `json:"traceId"`
+		}
+		if json.Unmarshal([]byte(line), &entry) == nil {
+			info.Level, _ = ParseLogLevel(entry.Level)
+			info.Key, info.TraceId = entry.Key, entry.TraceId
+			return info
+		}
+	}
+
+	// "15:04:05.000000 <colour><colour>KEY <reset>TRACEID|None <reset>message"
+	var b strings.Builder
+	first := true
+	for i := 0; i < len(line); {
+		end := strings.IndexByte(line[i:], 'm')
+		if line[i] != '\x1b' || end < 0 {
+			b.WriteByte(line[i])
+			i++
+			continue
+		}
+		if first {
+			info.Level = colorLevel(line[i : i+end+1])
+			first = false
+		}
+		i += end + 1
+	}
+	info.Text = b.String()
+
+	fields := strings.SplitN(info.Text, " ", 4)
+	if len(fields) < 3 || len(fields[0]) != len("15:04:05.000000") || fields[0][2] != ':' {
+		return info
+	}
+	info.Key = fields[1]
+	if fields[2] != "None" {
+		info.TraceId = fields[2]
+	}
+	return info
+}
+
+// flags used by log.Logger instances for the current encoder. JSON entries
+// carry their own timestamp
+func (lw *LogWriter) logFlags() int {
+	if lw.getEncoder() == EncoderJSON {
+		return 0
+	}
+	return log.Lmicroseconds
+}
+
+func (lw *LogWriter) getEncoder() Encoder {
+	return Encoder(lw.encoder.Load())
+}
+
+// Select the output encoder for the log and trace files
+func (lw *LogWriter) SetEncoder(encoder Encoder) {
+	lw.fileMu.Lock()
+	lw.encoder.Store(int32(encoder))
+	lw.logger.SetFlags(lw.logFlags())
+	lw.fileMu.Unlock()
+
+	lw.traceMu.RLock()
+	defer lw.traceMu.RUnlock()
+	for _, tl := range lw.traceFileMap {
+		tl.logger.SetFlags(lw.logFlags())
+	}
+}
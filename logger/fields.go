@@ -0,0 +1,161 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FieldFormat int
+
+const (
+	FieldsText FieldFormat = iota // key=value pairs
+	FieldsJSON                    // single JSON object
+)
+
+// A typed key/value pair attached to a structured log message
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Create a field holding an arbitrary value
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func String(key string, value string) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Int(key string, value int) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Int64(key string, value int64) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Uint64(key string, value uint64) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Float64(key string, value float64) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Field {
+	return Field{Key: key, Value: value}
+}
+
+// durations are rendered using time.Duration.String()
+func Duration(key string, value time.Duration) Field {
+	return Field{Key: key, Value: value}
+}
+
+// a nil error is rendered as an empty string
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "error", Value: ""}
+	}
+	return Field{Key: "error", Value: err.Error()}
+}
+
+// value as it should appear in the JSON encoding
+func (f Field) jsonValue() interface{} {
+	switch v := f.Value.(type) {
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return f.Value
+}
+
+// value as it should appear in the text encoding
+func (f Field) textValue() string {
+	var s string
+	switch v := f.Value.(type) {
+	case string:
+		s = v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Duration:
+		return v.String()
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// render a list of fields as space separated key=value pairs
+func fieldsText(fields []Field) string {
+	var buf bytes.Buffer
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		buf.WriteString(f.textValue())
+	}
+	return buf.String()
+}
+
+// render a list of fields as a JSON object. Field order is preserved
+func fieldsJSON(fields []Field) string {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.Key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(f.jsonValue())
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprintf("%v", f.Value))
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// render the fields using the configured format
+func renderFields(format FieldFormat, fields []Field) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	if format == FieldsJSON {
+		return fieldsJSON(fields)
+	}
+	return fieldsText(fields)
+}
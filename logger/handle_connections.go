@@ -10,95 +10,130 @@ package logger
 
 import (
 	"fmt"
-	"net"
+	"github.com/couchbase/retriever/protocol"
 	"os"
 	"strings"
 )
 
-func handleCommand(lw *LogWriter, c net.Conn, cmds []string, data string) {
+// commands of the log socket, in the order legacy text commands are matched
+var logCommands = []string{"levels", "level", "filelog", "rotate", "traceoff", "trace",
+	"alarmoff", "alarmlist", "alarm", "setpath", "keysoff", "keys"}
+
+// Levels of a module, returned by the levels command
+type LevelSettings struct {
+	Level string            `json:"level"`
+	Keys  map[string]string `json:"keys"` // enabled keys and their level, global when following Level
+}
+
+func (lw *LogWriter) levelSettings() LevelSettings {
+	info := LevelSettings{Level: lw.GetLogLevel().String(), Keys: make(map[string]string)}
+	for key, level := range lw.KeyLevels() {
+		info.Keys[key] = level.String()
+	}
+	return info
+}
+
+func handleRequest(lw *LogWriter, req *protocol.Request) *protocol.Response {
 
 	var err error
 
-	switch {
-	case strings.Contains(strings.ToLower(cmds[0]), "level"):
-		setLevel(lw, cmds[1])
-		c.Write([]byte("OK"))
-	case strings.Contains(strings.ToLower(cmds[0]), "filelog"):
-		sendfile(lw.filePath, c)
-	case strings.Contains(strings.ToLower(cmds[0]), "rotate"):
-		// rotate the current log file
-		err := lw.Rotate()
+	cmd := strings.ToLower(req.Command)
+	if req.Version == 0 {
+		cmd = protocol.LegacyCommand(cmd, logCommands)
+	}
+
+	switch cmd {
+	case "levels":
+		return protocol.NewResponse(lw.levelSettings())
+	case "level":
+		if err = setLevel(lw, req.Arg(0)); err != nil {
+			return protocol.ErrorResponse(protocol.StatusBadRequest, err)
+		}
+	case "filelog":
+		filePath := lw.GetFilePath()
+		file, err := os.Open(filePath)
 		if err != nil {
-			c.Write([]byte(err.Error()))
-		} else {
-			c.Write([]byte("OK"))
+			return protocol.ErrorResponse(protocol.StatusError,
+				fmt.Errorf("Cannot open file %s Error: %s", filePath, err.Error()))
 		}
-	case strings.Contains(strings.ToLower(cmds[0]), "traceoff"):
+		return protocol.StreamResponse(file)
+	case "rotate":
+		// rotate the current log file
+		if err = lw.Rotate(); err != nil {
+			return protocol.ErrorResponse(protocol.StatusError, err)
+		}
+	case "traceoff":
 		lw.DisableTraceLogging()
-		c.Write([]byte("OK"))
-
-	case strings.Contains(strings.ToLower(cmds[0]), "trace"):
+	case "trace":
 		lw.EnableTraceLogging()
-		c.Write([]byte("OK"))
-	case strings.Contains(strings.ToLower(cmds[0]), "alarmoff"):
-		lw.ClearAlarm()
-		c.Write([]byte("OK"))
-	case strings.Contains(strings.ToLower(cmds[0]), "alarm"):
-		lw.RegisterAlarm(cmds[1])
-		c.Write([]byte("OK"))
-	case strings.Contains(strings.ToLower(cmds[0]), "setpath"):
-		if err = lw.SetDefaultPath(cmds[1]); err != nil {
-			c.Write([]byte(err.Error()))
+	case "alarmoff":
+		// remove the named target, or all targets
+		if name := strings.TrimSpace(req.Arg(0)); name != "" {
+			if err = lw.RemoveAlarmTarget(name); err != nil {
+				return protocol.ErrorResponse(protocol.StatusNotFound, err)
+			}
+		} else {
+			lw.ClearAlarm()
+		}
+	case "alarmlist":
+		return protocol.NewResponse(lw.AlarmTargets())
+	case "alarm":
+		if err = setAlarm(lw, req.Arg(0)); err != nil {
+			return protocol.ErrorResponse(protocol.StatusBadRequest, err)
 		}
-		c.Write([]byte("OK"))
+	case "setpath":
+		if err = lw.SetDefaultPath(req.Arg(0)); err != nil {
+			return protocol.ErrorResponse(protocol.StatusBadRequest, err)
+		}
+	case "keys":
+		lw.EnableKeys(splitList(req.Arg(0)))
+	case "keysoff":
+		lw.DisableKeys(splitList(req.Arg(0)))
+	default:
+		return protocol.ErrorResponse(protocol.StatusNotFound, fmt.Errorf("Unknown command %s", req.Command))
 	}
-
+	return protocol.NewResponse(nil)
 }
 
-func setLevel(lw *LogWriter, level string) {
-
-	level = strings.ToLower(level)
-	switch {
-	case strings.Contains(level, "info"):
-		fmt.Printf("Setting to level info ")
-		lw.SetLogLevel(LevelInfo)
-	case strings.Contains(level, "warn"):
-		lw.SetLogLevel(LevelWarn)
-	case strings.Contains(level, "error"):
-		lw.SetLogLevel(LevelError)
-	case strings.Contains(level, "debug"):
-		lw.SetLogLevel(LevelDebug)
-	}
-
+// split a comma or space separated list
+func splitList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n'
+	})
 }
 
-func sendfile(filePath string, c net.Conn) {
+// set the global level and/or per key levels. The request is a comma or space
+// separated list of levels and key=level pairs e.g. "warn,DCP=debug"
+func setLevel(lw *LogWriter, request string) error {
 
-	file, err := os.OpenFile(filePath, os.O_RDWR, 0666)
-
-	if err != nil {
-		c.Write([]byte("Cannot open file " + filePath + "Error:" + err.Error()))
-		return
+	tokens := splitList(request)
+	if len(tokens) == 0 {
+		return fmt.Errorf("Missing log level")
 	}
-	defer file.Close()
-	buffer := make([]byte, 8192)
-	var bytesWr uint64
 
-	for {
-		n, err := file.Read(buffer)
-		if n > 0 {
-			bytes, sockerr := c.Write(buffer[0:n])
-			if sockerr != nil {
-				fmt.Printf("Error writing %s", sockerr.Error())
+	var failed []string
+	for _, token := range tokens {
+		if pair := strings.SplitN(token, "=", 2); len(pair) == 2 {
+			level, err := ParseLogLevel(pair[1])
+			if err == nil {
+				err = lw.SetKeyLevel(pair[0], level)
 			}
-			bytesWr += uint64(bytes)
-
+			if err != nil {
+				failed = append(failed, token)
+			}
+			continue
+		}
+		level, err := ParseLogLevel(token)
+		if err == nil {
+			err = lw.SetLogLevel(level)
 		}
 		if err != nil {
-			if bytesWr == 0 {
-				fmt.Printf("I/O error")
-			}
-			break
+			failed = append(failed, token)
 		}
 	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Invalid level %s", strings.Join(failed, ","))
+	}
+	return nil
 }
@@ -9,29 +9,21 @@
 package logger
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"github.com/couchbase/retriever/lockfile"
-	"io/ioutil"
+	"github.com/couchbase/retriever/registry"
 	"log"
-	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type LogLevel int8
 
-func getDefaultPath() string {
-	if runtime.GOOS == "windows" {
-		return os.Getenv("tmp")
-	} else {
-		return "/tmp"
-	}
-}
-
 func pathSeparator() string {
 	if runtime.GOOS == "windows" {
 		return "/"
@@ -50,6 +42,27 @@ const (
 	LevelDebug
 )
 
+// key level meaning the key follows the global log level
+const LevelGlobal = LogLevel(-1)
+
+// Parse a level name. "global" or "default" selects LevelGlobal
+func ParseLogLevel(level string) (LogLevel, error) {
+	level = strings.ToLower(level)
+	switch {
+	case strings.Contains(level, "info"):
+		return LevelInfo, nil
+	case strings.Contains(level, "warn"):
+		return LevelWarn, nil
+	case strings.Contains(level, "error"):
+		return LevelError, nil
+	case strings.Contains(level, "debug"):
+		return LevelDebug, nil
+	case strings.Contains(level, "global"), strings.Contains(level, "default"):
+		return LevelGlobal, nil
+	}
+	return LevelGlobal, fmt.Errorf("Invalid log level %s", level)
+}
+
 type logDevice int
 
 const (
@@ -61,44 +74,57 @@ const (
 type TraceLogger struct {
 	file     *os.File
 	logger   *log.Logger
-	counter  uint64
+	counter  atomic.Uint64     // value of logCounter when last used
 	fileLock lockfile.Lockfile // file lock used for trace logging
 }
 
-type AlarmMessage struct {
-	Module  string
-	TraceId string
-	Key     string
-	Message string
+// A LogWriter is safe for concurrent use. Hot fields are atomics, mu guards
+// keyList, fileMu guards the log file and traceMu the trace file map
+type LogWriter struct {
+	module         string                     // name of logging module
+	level          atomic.Int32               // current log level
+	keyList        map[string]LogLevel        // enabled keys and their level
+	mu             sync.Mutex                 // mutex for keyList
+	logger         *log.Logger                // instance of logger module
+	filePath       string                     // path of log file for this module
+	traceFileMap   map[string]*TraceLogger    // table of trace logs - trace id
+	traceMu        sync.RWMutex               // R/W mutex to sync access to the above structure
+	traceMode      atomic.Bool                // trace mode enabled
+	cleanerRunning atomic.Bool                // trace log cleaner process
+	logCounter     atomic.Uint64              // count of log messages
+	file           *os.File                   // file handle of log file
+	alarmEnabled   atomic.Bool                // endpoint alarms enabled
+	alarmLevel     atomic.Int32               // least severe level alarmed by any target
+	alarmTargets   []*alarmTarget             // alarm endpoints and their routing rules
+	alarmMu        sync.RWMutex               // mutex for alarmTargets and alarmLabels
+	alarmLabels    map[string]string          // labels sent with alarms
+	defaultPath    string                     // default logging path
+	runtimeDir     string                     // directory of the control socket, and of logs without defaultPath
+	color          atomic.Bool                // enable/disable colour logging
+	fieldFormat    atomic.Int32               // rendering of structured log fields
+	encoder        atomic.Int32               // output encoding of log lines
+	rotation       *RotationPolicy            // automatic rotation policy, nil if disabled
+	fileMu         sync.RWMutex               // guards logger, file, paths and rotation
+	fileSize       atomic.Int64               // bytes written to the current log file
+	fileOpened     time.Time                  // time the current log file was opened
+	async          atomic.Pointer[asyncQueue] // queue of the async writer, nil if synchronous
+	asyncMu        sync.Mutex                 // serialises EnableAsync and Close
+	dropped        atomic.Uint64              // messages dropped by closed async queues
+	sinks          []*sinkEntry               // additional log destinations
+	sinkMu         sync.RWMutex               // mutex for sinks
 }
 
-type LogWriter struct {
-	module         string                 // name of logging module
-	level          LogLevel               // current log leve
-	keyList        map[string]bool        // list of enabled keys
-	mu             sync.Mutex             // mutex for this structure
-	logger         *log.Logger            // instance of logger module
-	filePath       string                 // path of log file for this module
-	traceFileMap   map[string]interface{} // table of trace logs - trace id
-	traceMu        sync.RWMutex           // R/W mutex to sync access to the above structure
-	traceMode      bool                   // trace mode enabled
-	cleanerRunning bool                   // trace log cleaner process
-	logCounter     uint64                 // count of log messages
-	file           *os.File               // file handle of log file
-	alarmEnabled   bool                   // endpoint alarms enabled
-	alarmLogger    AlarmLogger            // instance of alarm logger
-	defaultPath    string                 // default logging path
-	color          bool                   // enable/disable colour logging
-}
-
-type AlarmLogger struct {
-	endpoint string            // address of alarm endpoint
-	cMsg     chan AlarmMessage // channel used to communicate messages to remote server
-	cStop    chan bool         // stop channel
+type LoggerOptions struct {
+	RuntimeDir string // control socket, registry, log and trace files. Defaults to registry.DefaultRuntimeDir()
 }
 
 // Create a new instance of a logWriter
 func NewLogger(module string, level LogLevel) (*LogWriter, error) {
+	return NewLoggerOptions(module, level, LoggerOptions{})
+}
+
+// Create a new instance of a logWriter using the given runtime directory
+func NewLoggerOptions(module string, level LogLevel, opts LoggerOptions) (*LogWriter, error) {
 
 	if module == "" {
 		return nil, fmt.Errorf("Required module name")
@@ -109,28 +135,22 @@ func NewLogger(module string, level LogLevel) (*LogWriter, error) {
 		level = LevelWarn
 	}
 
-	var lw *LogWriter
+	if opts.RuntimeDir == "" {
+		opts.RuntimeDir = registry.DefaultRuntimeDir()
+	}
 
-	if runtime.GOOS == "windows" {
-		// disable color logging on windows
-		lw = &LogWriter{module: module,
-			level:        level,
-			keyList:      make(map[string]bool),
-			logger:       log.New(os.Stderr, "", log.Lmicroseconds),
-			traceFileMap: make(map[string]interface{}),
-			color:        false,
-		}
-	} else {
-		lw = &LogWriter{module: module,
-			level:        level,
-			keyList:      make(map[string]bool),
-			logger:       log.New(os.Stderr, "", log.Lmicroseconds),
-			traceFileMap: make(map[string]interface{}),
-			color:        true,
-		}
+	lw := &LogWriter{module: module,
+		runtimeDir:   opts.RuntimeDir,
+		keyList:      make(map[string]LogLevel),
+		logger:       log.New(os.Stderr, "", log.Lmicroseconds),
+		traceFileMap: make(map[string]*TraceLogger),
 	}
+	lw.level.Store(int32(level))
+
+	// disable color logging on windows
+	lw.color.Store(runtime.GOOS != "windows")
 
-	lw.keyList["Default"] = true
+	lw.keyList["Default"] = LevelGlobal
 
 	go handleConnections(lw, module)
 	return lw, nil
@@ -144,18 +164,26 @@ type Message struct {
 // Set the log level
 func (lw *LogWriter) SetLogLevel(level LogLevel) error {
 
-	if lw.level > LevelDebug || lw.level < LevelError {
+	if level > LevelDebug || level < LevelError {
 		return fmt.Errorf("Log level unchanged")
 	}
-	lw.level = level
+	lw.level.Store(int32(level))
 	return nil
 }
 
+// Return the global log level
+func (lw *LogWriter) GetLogLevel() LogLevel {
+	return LogLevel(lw.level.Load())
+}
+
 // Set the output device. Use module Id for name
 func (lw *LogWriter) SetFile() error {
 
+	lw.fileMu.Lock()
+	defer lw.fileMu.Unlock()
+
 	if lw.defaultPath == "" {
-		lw.filePath = getDefaultPath() + pathSeparator() + lw.module + ".log"
+		lw.filePath = lw.runtimeDir + pathSeparator() + lw.module + ".log"
 	} else {
 		lw.filePath = lw.defaultPath + pathSeparator() + lw.module + ".log"
 	}
@@ -165,13 +193,36 @@ func (lw *LogWriter) SetFile() error {
 		return fmt.Errorf("Unable to open file %s", err.Error())
 	}
 
+	if lw.file != nil {
+		lw.file.Close()
+	}
 	lw.file = fp
-	lw.logger = log.New(fp, "", log.Lmicroseconds)
+	lw.setLogFile(fp)
+	lw.registerLogDir(filepath.Dir(lw.filePath))
 	return nil
 }
 
-// set the default logging path. If trace logging is not enabled then only new trace
-// files will use the new default path.
+// Return the path of the log file, empty if logging to stderr
+func (lw *LogWriter) GetFilePath() string {
+	lw.fileMu.RLock()
+	defer lw.fileMu.RUnlock()
+	if lw.file == nil {
+		return ""
+	}
+	return lw.filePath
+}
+
+// record the log directory in the registry so the retriever can find the log
+// and trace files. Called with fileMu held
+func (lw *LogWriter) registerLogDir(dir string) {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	registry.SetLogDir(registry.Dir(lw.runtimeDir), lw.module, dir)
+}
+
+// set the default logging path. Trace files already open stay in the previous
+// path, new trace files use the new default path.
 
 func (lw *LogWriter) SetDefaultPath(defaultPath string) error {
 
@@ -179,6 +230,9 @@ func (lw *LogWriter) SetDefaultPath(defaultPath string) error {
 		return fmt.Errorf("No path specified")
 	}
 
+	lw.fileMu.Lock()
+	defer lw.fileMu.Unlock()
+
 	if lw.defaultPath == defaultPath {
 		return nil
 	}
@@ -189,70 +243,92 @@ func (lw *LogWriter) SetDefaultPath(defaultPath string) error {
 		return fmt.Errorf("Unable access path %s", err.Error())
 	}
 	lw.defaultPath = defaultPath
+	lw.registerLogDir(defaultPath)
 
 	if lw.file != nil {
 		// switch the log file
 		lw.file.Close()
 		lw.file = fp
 		lw.filePath = newPath
-		lw.logger = log.New(fp, "", log.Lmicroseconds)
-	}
-
-	return nil
-}
-
-// Rotate the current log file
-func (lw *LogWriter) Rotate() error {
-	renamePath := fmt.Sprintf("%s.%s", lw.filePath, time.Now().String())
-	err := os.Rename(lw.filePath, renamePath)
-	if err != nil {
-		return err
-	}
-
-	fp, err := os.OpenFile(lw.filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		return fmt.Errorf("Unable to open file %s", err.Error())
+		lw.setLogFile(fp)
+	} else {
+		fp.Close()
 	}
 
-	lw.logger = log.New(fp, "", log.Lmicroseconds)
-	lw.file.Close()
-	lw.file = fp
-
 	return nil
 }
 
 // Set the logging to the log to a trace file
 func (lw *LogWriter) EnableTraceLogging() {
-	lw.traceMode = true
-	if lw.cleanerRunning == false {
-		go cleanupMap(lw)
-		lw.cleanerRunning = true
-	}
+	lw.traceMode.Store(true)
+	lw.startCleaner()
 }
 
 // Disable logging to a trace file
 func (lw *LogWriter) DisableTraceLogging() {
-	lw.traceMode = false
+	lw.traceMode.Store(false)
 }
 
-// Set the remote host
-func (lw *LogWriter) SetLogHost(string) error {
-	return nil
+// start the trace file cleaner unless it is already running
+func (lw *LogWriter) startCleaner() {
+	if lw.cleanerRunning.CompareAndSwap(false, true) {
+		go cleanupMap(lw)
+	}
 }
 
-//enable component keys
+// return the current logger of the log file
+func (lw *LogWriter) currentLogger() *log.Logger {
+	lw.fileMu.RLock()
+	defer lw.fileMu.RUnlock()
+	return lw.logger
+}
+
+//enable component keys. Keys log at the global level unless a key level is set
 func (lw *LogWriter) EnableKeys(keys []string) error {
 	lw.mu.Lock()
 	defer lw.mu.Unlock()
 	for _, key := range keys {
-		lw.keyList[key] = true
+		if _, found := lw.keyList[key]; !found {
+			lw.keyList[key] = LevelGlobal
+		}
 	}
 	return nil
 }
 
+// Set the log level of a component key, enabling it if required. LevelGlobal
+// makes the key follow the global log level again
+func (lw *LogWriter) SetKeyLevel(key string, level LogLevel) error {
+	if level != LevelGlobal && (level > LevelDebug || level < LevelError) {
+		return fmt.Errorf("Log level unchanged")
+	}
+	if key == "" {
+		key = "Default"
+	}
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.keyList[key] = level
+	return nil
+}
+
+// Return the enabled keys and their level
+func (lw *LogWriter) KeyLevels() map[string]LogLevel {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	keys := make(map[string]LogLevel, len(lw.keyList))
+	for key, level := range lw.keyList {
+		keys[key] = level
+	}
+	return keys
+}
+
 // Enable/Disable color logging
 func (lw *LogWriter) SetColor(value bool) {
-	lw.color = value
+	lw.color.Store(value)
+}
+
+// Set the rendering format of structured log fields
+func (lw *LogWriter) SetFieldFormat(format FieldFormat) {
+	lw.fieldFormat.Store(int32(format))
 }
 
 // disable component keys
@@ -266,47 +342,79 @@ func (lw *LogWriter) DisableKeys(keys []string) error {
 	return nil
 }
 
-// Check to see if logging is enabled for a key
-func (lw *LogWriter) keyEnabled(key string) bool {
-	_, found := lw.keyList[key]
-	return found
+// Check to see if logging is enabled for a key at the given level
+func (lw *LogWriter) keyEnabled(key string, level LogLevel) bool {
+	lw.mu.Lock()
+	keyLevel, found := lw.keyList[key]
+	lw.mu.Unlock()
+	if !found {
+		return false
+	}
+	if keyLevel == LevelGlobal {
+		keyLevel = lw.GetLogLevel()
+	}
+	return keyLevel >= level
 }
 
-func (lw *LogWriter) logTrace(traceId string, logString string) bool {
-	var logger *log.Logger
+// highest level enabled for any key
+func (lw *LogWriter) maxLevel() LogLevel {
+	level := lw.GetLogLevel()
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	for _, keyLevel := range lw.keyList {
+		if keyLevel > level {
+			level = keyLevel
+		}
+	}
+	return level
+}
+
+// return the trace logger for a trace id, creating the trace file if required
+func (lw *LogWriter) getTraceLogger(traceId string) (*TraceLogger, error) {
 	lw.traceMu.RLock()
 	tl := lw.traceFileMap[traceId]
 	lw.traceMu.RUnlock()
-	if tl == nil {
-		filePath := getDefaultPath() + pathSeparator() + "trace_" + traceId + ".log"
-		file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			lw.logger.Print("Logger: Unable to create trace file %s, Error %s", filePath, err.Error())
-			return false
-		}
-		logger = log.New(file, "", log.Lmicroseconds)
-		fileLockPath := getDefaultPath() + pathSeparator() + "trace_" + traceId + ".lock"
-		fl, _ := lockfile.New(fileLockPath)
-		tl = &TraceLogger{file: file, logger: logger, counter: lw.logCounter, fileLock: fl}
-		lw.traceMu.Lock()
-		lw.traceFileMap[traceId] = tl
-		lw.traceMu.Unlock()
-		if lw.cleanerRunning == false {
-			// restart the cleaner
-			go cleanupMap(lw)
-		}
-	} else {
-		logger = tl.(*TraceLogger).logger
-		tl.(*TraceLogger).counter = lw.logCounter
+	if tl != nil {
+		return tl, nil
 	}
 
+	dir := lw.logDir()
+	lw.traceMu.Lock()
+	defer lw.traceMu.Unlock()
+	if tl = lw.traceFileMap[traceId]; tl != nil {
+		return tl, nil
+	}
+
+	filePath := dir + pathSeparator() + "trace_" + traceId + ".log"
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create trace file %s, Error %s", filePath, err.Error())
+	}
+	fileLockPath := dir + pathSeparator() + "trace_" + traceId + ".lock"
+	fl, _ := lockfile.New(fileLockPath)
+	tl = &TraceLogger{file: file, logger: log.New(file, "", lw.logFlags()), fileLock: fl}
+	lw.traceFileMap[traceId] = tl
+
+	// restart the cleaner
+	lw.startCleaner()
+	return tl, nil
+}
+
+func (lw *LogWriter) logTrace(traceId string, logString string) bool {
+	tl, err := lw.getTraceLogger(traceId)
+	if err != nil {
+		lw.currentLogger().Print("Logger: ", err.Error())
+		return false
+	}
+	tl.counter.Store(lw.logCounter.Load())
+
 	var locked bool
-	err := tl.(*TraceLogger).fileLock.TryLock()
+	err = tl.fileLock.TryLock()
 	if err != nil {
 		// busy wait a few times before giving up
 		for i := 0; i < MAX_LOCK_RETRY; i++ {
 			time.Sleep(10 * time.Millisecond)
-			err = tl.(*TraceLogger).fileLock.TryLock()
+			err = tl.fileLock.TryLock()
 			if err == nil {
 				locked = true
 				break
@@ -317,9 +425,9 @@ func (lw *LogWriter) logTrace(traceId string, logString string) bool {
 			return false
 		}
 	}
-	defer tl.(*TraceLogger).fileLock.Unlock()
+	defer tl.fileLock.Unlock()
 
-	logger.Print(logString)
+	tl.logger.Print(logString)
 	return true
 }
 
@@ -327,63 +435,86 @@ func (lw *LogWriter) logTrace(traceId string, logString string) bool {
 func cleanupMap(lw *LogWriter) {
 	defer func() {
 		if r := recover(); r != nil {
-			lw.logger.Print("Logger: Crash in cleanupMap")
-			lw.cleanerRunning = false
+			lw.currentLogger().Print("Logger: Crash in cleanupMap")
+			lw.cleanerRunning.Store(false)
 		}
 	}()
 
 	for {
-		if len(lw.traceFileMap) > 0 {
-			for key, _ := range lw.traceFileMap {
-				tl := lw.traceFileMap[key].(*TraceLogger)
-				if lw.logCounter-tl.counter >= MAX_CLEANUP_COUNTER {
-					fmt.Println("Closing File ", tl.file.Name())
-					tl.file.Close()
-					lw.traceMu.Lock()
-					delete(lw.traceFileMap, key)
-					lw.traceMu.Unlock()
-				}
-			}
-		} else {
-			if lw.traceMode == false && len(lw.traceFileMap) == 0 {
-				lw.cleanerRunning = false
-				return
+		lw.traceMu.Lock()
+		for key, tl := range lw.traceFileMap {
+			if lw.logCounter.Load()-tl.counter.Load() >= MAX_CLEANUP_COUNTER {
+				fmt.Println("Closing File ", tl.file.Name())
+				tl.file.Close()
+				delete(lw.traceFileMap, key)
 			}
 		}
+		if lw.traceMode.Load() == false && len(lw.traceFileMap) == 0 {
+			lw.cleanerRunning.Store(false)
+			lw.traceMu.Unlock()
+			return
+		}
+		lw.traceMu.Unlock()
 		time.Sleep(5 * time.Second)
 	}
 }
 
-func (lw *LogWriter) logMessage(color string, traceId string, key string, format string, args ...interface{}) {
+func (lw *LogWriter) logMessage(level LogLevel, traceId string, key string, fields []Field, format string, args ...interface{}) {
+	entry := &Record{
+		Time:    time.Now(),
+		Level:   level,
+		Module:  lw.module,
+		Key:     key,
+		TraceId: traceId,
+		Message: fmt.Sprintf(format, args...),
+		Fields:  fields,
+	}
+
+	if lw.getEncoder() == EncoderJSON {
+		// skip logMessage and the LogXXX wrapper
+		entry.Caller = getCaller(2)
+	}
+	lw.writeEntry(entry)
+}
+
+// hand an entry to the async queue, or write it out directly
+func (lw *LogWriter) writeEntry(entry *Record) {
+	if q := lw.async.Load(); q != nil && q.put(entry) {
+		return
+	}
+	lw.outputEntry(entry)
+}
+
+// encode an entry and write it to the trace file or the log file
+func (lw *LogWriter) outputEntry(entry *Record) {
 	var logString string
-	lw.logCounter++
+	lw.logCounter.Add(1)
 
-	if lw.color == false {
+	lw.writeSinks(entry)
+
+	encoder := lw.getEncoder()
+	color := levelColor(entry.Level)
+	if lw.color.Load() == false || encoder == EncoderJSON {
 		color = reset
 	}
 
-	// color formatting doesn't work on windows.
-	if runtime.GOOS == "windows" {
-		if traceId != "" {
-			logString = fmt.Sprintf("%s %s %s", key, traceId, fmt.Sprintf(format, args...))
-		} else {
-			logString = fmt.Sprintf("%s None %s", key, fmt.Sprintf(format, args...))
-		}
+	if encoder == EncoderJSON {
+		logString = encodeJSON(entry)
 	} else {
-		if traceId != "" {
-			logString = fmt.Sprintf("%s %s %s", color+key, reset+traceId, fmt.Sprintf(format, args...))
-		} else {
-			logString = fmt.Sprintf("%s None %s", color+key, reset+fmt.Sprintf(format, args...))
-		}
+		logString = encodeText(entry, color, FieldFormat(lw.fieldFormat.Load()))
 	}
 
-	if lw.traceMode == true && len(traceId) > 0 {
-		if lw.logTrace(traceId, logString) {
+	if lw.traceMode.Load() == true && len(entry.TraceId) > 0 {
+		if lw.logTrace(entry.TraceId, logString) {
 			return
 		}
 	}
 
-	if runtime.GOOS == "windows" {
+	lw.checkRotate()
+
+	lw.fileMu.RLock()
+	defer lw.fileMu.RUnlock()
+	if runtime.GOOS == "windows" || encoder == EncoderJSON {
 		lw.logger.Print(logString)
 	} else {
 		lw.logger.Print(color, logString)
@@ -392,92 +523,105 @@ func (lw *LogWriter) logMessage(color string, traceId string, key string, format
 
 // log debug. trace id, component id, log message
 func (lw *LogWriter) LogDebug(traceId string, key string, format string, args ...interface{}) {
-	if lw.level >= LevelDebug {
-		if key == "" {
-			key = "Default"
-		}
-		if lw.keyEnabled(key) {
-			lw.logMessage(fgWhite, traceId, key, format, args...)
-		}
+	if key == "" {
+		key = "Default"
+	}
+	if lw.keyEnabled(key, LevelDebug) {
+		lw.logMessage(LevelDebug, traceId, key, nil, format, args...)
+	}
+	if lw.alarmWanted(LevelDebug) {
+		lw.raiseAlarm(LevelDebug, traceId, key, format, fmt.Sprintf(format, args...), getCaller(1))
 	}
 }
 
 //log info. trace id, component id, log message
 func (lw *LogWriter) LogInfo(traceId string, key string, format string, args ...interface{}) {
-	if lw.level >= LevelInfo {
-		if key == "" {
-			key = "Default"
-		}
-		if lw.keyEnabled(key) {
-			lw.logMessage(fgBlue, traceId, key, format, args...)
-		}
+	if key == "" {
+		key = "Default"
+	}
+	if lw.keyEnabled(key, LevelInfo) {
+		lw.logMessage(LevelInfo, traceId, key, nil, format, args...)
+	}
+	if lw.alarmWanted(LevelInfo) {
+		lw.raiseAlarm(LevelInfo, traceId, key, format, fmt.Sprintf(format, args...), getCaller(1))
 	}
 }
 
 //log warning trace id, component id, log message
 func (lw *LogWriter) LogWarn(traceId string, key string, format string, args ...interface{}) {
-	if lw.level >= LevelWarn {
-		if key == "" {
-			key = "Default"
-		}
-		if lw.keyEnabled(key) {
-			lw.logMessage(fgYellow, traceId, key, format, args...)
-		}
+	if key == "" {
+		key = "Default"
+	}
+	if lw.keyEnabled(key, LevelWarn) {
+		lw.logMessage(LevelWarn, traceId, key, nil, format, args...)
+	}
+	if lw.alarmWanted(LevelWarn) {
+		lw.raiseAlarm(LevelWarn, traceId, key, format, fmt.Sprintf(format, args...), getCaller(1))
 	}
 }
 
 //log error trace id, component id, log message
 func (lw *LogWriter) LogError(traceId string, key string, format string, args ...interface{}) {
-	if lw.level >= LevelError {
-		if key == "" {
-			key = "Default"
-		}
-		if lw.keyEnabled(key) {
-			lw.logMessage(fgRed, traceId, key, format, args...)
-		}
-		if lw.alarmEnabled == true {
-			// send alarm to remote host
-			message := fmt.Sprintf(format, args...)
-			lw.alarmLogger.cMsg <- AlarmMessage{Module: lw.module, Key: key, TraceId: traceId, Message: message}
-		}
+	if key == "" {
+		key = "Default"
+	}
+	if lw.keyEnabled(key, LevelError) {
+		lw.logMessage(LevelError, traceId, key, nil, format, args...)
+	}
+	if lw.alarmWanted(LevelError) {
+		lw.raiseAlarm(LevelError, traceId, key, format, fmt.Sprintf(format, args...), getCaller(1))
 	}
 }
 
-// register alarm endpoint. Any error log will be sent to this remote endpoint
-func (lw *LogWriter) RegisterAlarm(endpoint string) error {
-
-	if lw.alarmEnabled == false {
-		lw.alarmLogger = AlarmLogger{endpoint: endpoint, cMsg: make(chan AlarmMessage), cStop: make(chan bool)}
-		lw.alarmEnabled = true
-		go sendAlarm(endpoint, lw.alarmLogger.cMsg, lw.alarmLogger.cStop)
+// structured log debug. trace id, component id, log message, fields
+func (lw *LogWriter) LogDebugKV(traceId string, key string, msg string, fields ...Field) {
+	if key == "" {
+		key = "Default"
+	}
+	if lw.keyEnabled(key, LevelDebug) {
+		lw.logMessage(LevelDebug, traceId, key, fields, "%s", msg)
+	}
+	if lw.alarmWanted(LevelDebug) {
+		lw.raiseAlarm(LevelDebug, traceId, key, msg, msg, getCaller(1), fields...)
 	}
-	return nil
 }
 
-func (lw *LogWriter) ClearAlarm() {
-	lw.alarmEnabled = false
-	lw.alarmLogger.cStop <- true
+// structured log info. trace id, component id, log message, fields
+func (lw *LogWriter) LogInfoKV(traceId string, key string, msg string, fields ...Field) {
+	if key == "" {
+		key = "Default"
+	}
+	if lw.keyEnabled(key, LevelInfo) {
+		lw.logMessage(LevelInfo, traceId, key, fields, "%s", msg)
+	}
+	if lw.alarmWanted(LevelInfo) {
+		lw.raiseAlarm(LevelInfo, traceId, key, msg, msg, getCaller(1), fields...)
+	}
 }
 
-func sendAlarm(endpoint string, cMsg chan AlarmMessage, cStop chan bool) {
+// structured log warning. trace id, component id, log message, fields
+func (lw *LogWriter) LogWarnKV(traceId string, key string, msg string, fields ...Field) {
+	if key == "" {
+		key = "Default"
+	}
+	if lw.keyEnabled(key, LevelWarn) {
+		lw.logMessage(LevelWarn, traceId, key, fields, "%s", msg)
+	}
+	if lw.alarmWanted(LevelWarn) {
+		lw.raiseAlarm(LevelWarn, traceId, key, msg, msg, getCaller(1), fields...)
+	}
+}
 
-	client := &http.Client{}
-	ok := true
-	for ok {
-		select {
-		case msg := <-cMsg:
-			reqBody, _ := json.Marshal(msg)
-			r, _ := http.NewRequest("POST", endpoint, bytes.NewBufferString(string(reqBody)))
-			resp, err := client.Do(r)
-			if err != nil {
-				log.Print(fgWhite, "Logger Error sending request to endpoint %s", err.Error())
-				continue
-			}
-			ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
-		case <-cStop:
-			ok = false
-		}
+// structured log error. trace id, component id, log message, fields
+func (lw *LogWriter) LogErrorKV(traceId string, key string, msg string, fields ...Field) {
+	if key == "" {
+		key = "Default"
+	}
+	if lw.keyEnabled(key, LevelError) {
+		lw.logMessage(LevelError, traceId, key, fields, "%s", msg)
+	}
+	if lw.alarmWanted(LevelError) {
+		lw.raiseAlarm(LevelError, traceId, key, msg, msg, getCaller(1), fields...)
 	}
 }
 
@@ -9,7 +9,22 @@
 package logger
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/retriever/registry"
+	"github.com/couchbase/retriever/stats"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -77,3 +92,993 @@ func TestLogger(t *testing.T) {
 	}
 
 }
+
+func TestStructuredFields(t *testing.T) {
+
+	fields := []Field{String("bucket", "default"), Int("vbucket", 12),
+		Duration("latency", 1500*time.Microsecond), String("msg", "two words")}
+
+	text := renderFields(FieldsText, fields)
+	expected := `bucket=default vbucket=12 latency=1.5ms msg="two words"`
+	if text != expected {
+		t.Errorf("Failed ! got %s expected %s", text, expected)
+	}
+
+	js := renderFields(FieldsJSON, fields)
+	expected = `{"bucket":"default","vbucket":12,"latency":"1.5ms","msg":"two words"}`
+	if js != expected {
+		t.Errorf("Failed ! got %s expected %s", js, expected)
+	}
+
+	mylog, err := NewLogger("testkv", LevelDebug)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	mylog.EnableKeys([]string{"DCP"})
+	mylog.LogInfoKV("", "DCP", "stream opened", fields...)
+	mylog.SetFieldFormat(FieldsJSON)
+	mylog.LogDebugKV("0x008", "DCP", "stream closed", Bool("clean", true))
+}
+
+func TestJSONEncoder(t *testing.T) {
+
+	mylog, err := NewLogger("testjson", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	dir := t.TempDir()
+	if err = mylog.SetDefaultPath(dir); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	mylog.SetEncoder(EncoderJSON)
+	mylog.LogWarn("0x009", "", "disk %s is full", "/data")
+	mylog.LogInfoKV("", "", "rebalance done", Int("moved", 42))
+
+	fp, err := os.Open(dir + "/testjson.log")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	defer fp.Close()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Failed ! invalid JSON line %s: %s", scanner.Text(), err.Error())
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("Failed ! expected 2 lines got %d", len(lines))
+	}
+	if lines[0]["level"] != "warn" || lines[0]["module"] != "testjson" ||
+		lines[0]["traceId"] != "0x009" || lines[0]["message"] != "disk /data is full" {
+		t.Errorf("Failed ! unexpected entry %v", lines[0])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, lines[0]["timestamp"].(string)); err != nil {
+		t.Errorf("Failed ! bad timestamp %s", err.Error())
+	}
+	if caller, _ := lines[0]["caller"].(string); caller == "" || caller[:len("logger_test.go")] != "logger_test.go" {
+		t.Errorf("Failed ! unexpected caller %v", lines[0]["caller"])
+	}
+	if fields, ok := lines[1]["fields"].(map[string]interface{}); !ok || fields["moved"] != float64(42) {
+		t.Errorf("Failed ! unexpected fields %v", lines[1]["fields"])
+	}
+}
+
+func TestSlogHandler(t *testing.T) {
+
+	mylog, err := NewLogger("testslog", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	dir := t.TempDir()
+	mylog.SetDefaultPath(dir)
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	mylog.EnableKeys([]string{"DCP"})
+
+	sl := slog.New(NewSlogHandler(mylog, nil))
+	sl.Debug("below level", "key", "DCP")
+	sl.Info("key not enabled", "key", "XDCR")
+	sl.With("key", "DCP").WithGroup("stream").Warn("stream closed", "traceId", "0x010", "vb", 12)
+
+	mylog.SetLogLevel(LevelDebug)
+	sl.Debug("now enabled", "key", "DCP")
+
+	data, err := os.ReadFile(dir + "/testslog.log")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	log := string(data)
+	if strings.Contains(log, "below level") || strings.Contains(log, "key not enabled") {
+		t.Errorf("Failed ! unexpected entries in %s", log)
+	}
+	if !strings.Contains(log, "stream closed stream.traceId=0x010 stream.vb=12") {
+		t.Errorf("Failed ! missing warning in %s", log)
+	}
+	if !strings.Contains(log, "now enabled") {
+		t.Errorf("Failed ! missing debug in %s", log)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+
+	mylog, err := NewLogger("testparse", LevelDebug)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	dir := t.TempDir()
+	mylog.SetDefaultPath(dir)
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	mylog.EnableKeys([]string{"DCP"})
+	mylog.SetColor(true)
+	mylog.LogWarn("0x007", "DCP", "stream closed")
+	mylog.SetColor(false)
+	mylog.LogError("", "DCP", "no colour")
+	mylog.SetEncoder(EncoderJSON)
+	mylog.LogInfo("0x008", "DCP", "json")
+
+	data, err := os.ReadFile(dir + "/testparse.log")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Failed ! expected 3 lines got %q", lines)
+	}
+	expected := []LineInfo{
+		{Level: LevelWarn, Key: "DCP", TraceId: "0x007"},
+		{Level: LevelGlobal, Key: "DCP"},
+		{Level: LevelInfo, Key: "DCP", TraceId: "0x008"},
+	}
+	if runtime.GOOS == "windows" {
+		expected[0].Level = LevelGlobal
+	}
+	for i, line := range lines {
+		info := ParseLine(line)
+		if info.Level != expected[i].Level || info.Key != expected[i].Key || info.TraceId != expected[i].TraceId ||
+			strings.Contains(info.Text, "\x1b") {
+			t.Errorf("Failed ! line %q parsed as %+v", line, info)
+		}
+	}
+	if info := ParseLine("second line of a message"); info.Key != "" || info.Level != LevelGlobal {
+		t.Errorf("Failed ! continuation line parsed as %+v", info)
+	}
+}
+
+func TestRotationPolicy(t *testing.T) {
+
+	mylog, err := NewLogger("testrotate", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	dir := t.TempDir()
+	mylog.SetDefaultPath(dir)
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.SetRotationPolicy(&RotationPolicy{MaxSize: 256, MaxFiles: 2}); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	for i := 0; i < 50; i++ {
+		mylog.LogWarn("", "", "filling up the log file with message %d", i)
+	}
+
+	rotated, _ := filepath.Glob(dir + "/testrotate.log.*")
+	if len(rotated) != 2 {
+		t.Errorf("Failed ! expected 2 rotated files got %v", rotated)
+	}
+	for _, fileName := range rotated {
+		suffix := strings.TrimPrefix(fileName, dir+"/testrotate.log.")
+		if _, err := time.Parse(ROTATE_TIME_FORMAT, suffix); err != nil {
+			t.Errorf("Failed ! unexpected rotated name %s", fileName)
+		}
+	}
+	if matched, _ := filepath.Match("*.log*", filepath.Base(rotated[0])); !matched {
+		t.Errorf("Failed ! %s not matched by *.log*", rotated[0])
+	}
+}
+
+func TestAsyncWriter(t *testing.T) {
+
+	// overflow policies on a queue without a flusher
+	q := newAsyncQueue(AsyncOptions{QueueSize: 2, Overflow: OverflowDropOldest})
+	for i := 0; i < 3; i++ {
+		q.put(&Record{Message: fmt.Sprintf("%d", i)})
+	}
+	if q.dropped.Load() != 1 || q.count != 2 || q.buf[q.head].Message != "1" {
+		t.Errorf("Failed ! drop oldest dropped %d count %d", q.dropped.Load(), q.count)
+	}
+	q = newAsyncQueue(AsyncOptions{QueueSize: 2, Overflow: OverflowDropNewest})
+	for i := 0; i < 3; i++ {
+		q.put(&Record{Message: fmt.Sprintf("%d", i)})
+	}
+	if q.dropped.Load() != 1 || q.count != 2 || q.buf[q.head].Message != "0" {
+		t.Errorf("Failed ! drop newest dropped %d count %d", q.dropped.Load(), q.count)
+	}
+
+	mylog, err := NewLogger("testasync", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	dir := t.TempDir()
+	mylog.SetDefaultPath(dir)
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.EnableAsync(AsyncOptions{QueueSize: 16}); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	sc, err := stats.NewStatsCollector("testasync")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.RegisterStats(sc); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	for i := 0; i < 100; i++ {
+		mylog.LogWarn("", "", "async message %d", i)
+	}
+	if err = mylog.Flush(); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+	data, _ := os.ReadFile(dir + "/testasync.log")
+	if lines := strings.Count(string(data), "\n"); lines != 100 {
+		t.Errorf("Failed ! expected 100 lines got %d", lines)
+	}
+	if dropped := sc.GetStat("log_testasync_dropped"); dropped != uint64(0) {
+		t.Errorf("Failed ! unexpected dropped count %v", dropped)
+	}
+	if err = mylog.Close(); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+}
+
+func TestKeyLevels(t *testing.T) {
+
+	mylog, err := NewLogger("testkeylevel", LevelWarn)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	mylog.EnableKeys([]string{"XDCR"})
+	if err = setLevel(mylog, "info,DCP=debug"); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	if !mylog.keyEnabled("DCP", LevelDebug) {
+		t.Errorf("Failed ! DCP should log at debug")
+	}
+	if mylog.keyEnabled("XDCR", LevelDebug) || !mylog.keyEnabled("XDCR", LevelInfo) {
+		t.Errorf("Failed ! XDCR should follow the global level")
+	}
+	if mylog.keyEnabled("GSI", LevelError) {
+		t.Errorf("Failed ! GSI is not enabled")
+	}
+
+	if err = setLevel(mylog, "DCP=global XDCR=error"); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if mylog.keyEnabled("DCP", LevelDebug) || !mylog.keyEnabled("DCP", LevelInfo) {
+		t.Errorf("Failed ! DCP should follow the global level")
+	}
+	if mylog.keyEnabled("XDCR", LevelWarn) {
+		t.Errorf("Failed ! XDCR should log errors only")
+	}
+
+	if err = setLevel(mylog, "DCP=loud"); err == nil {
+		t.Errorf("Failed ! invalid level accepted")
+	}
+}
+
+func TestSinks(t *testing.T) {
+
+	mylog, err := NewLogger("testsinks", LevelDebug)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	dir := t.TempDir()
+	fileSink, err := NewFileSink(dir+"/sink.log", EncoderText)
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.AddSink("file", fileSink, LevelDebug); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	defer udp.Close()
+	syslogSink, err := NewSyslogSink(SyslogOptions{Network: "udp", Address: udp.LocalAddr().String(),
+		AppName: "retriever", Facility: SyslogFacilityLocal0})
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.AddSink("syslog", syslogSink, LevelWarn); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.AddSink("syslog", syslogSink, LevelWarn); err == nil {
+		t.Errorf("Failed ! duplicate sink accepted")
+	}
+
+	mylog.LogDebug("", "", "debug goes to the file only")
+	mylog.LogWarnKV("0x011", "", "disk almost full", Int("pct", 91))
+
+	buf := make([]byte, 1024)
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := udp.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	msg := string(buf[:n])
+	// local0 (16) * 8 + warning (4)
+	if !strings.HasPrefix(msg, "<132>1 ") || !strings.Contains(msg, " retriever ") ||
+		!strings.HasSuffix(msg, " Default - 0x011 disk almost full pct=91") {
+		t.Errorf("Failed ! unexpected syslog message %s", msg)
+	}
+
+	if err = mylog.RemoveSink("file"); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+	data, _ := os.ReadFile(dir + "/sink.log")
+	if !strings.Contains(string(data), "debug Default None debug goes to the file only") ||
+		!strings.Contains(string(data), "warn Default 0x011 disk almost full pct=91") {
+		t.Errorf("Failed ! unexpected file sink contents %s", data)
+	}
+	if sinks := mylog.Sinks(); len(sinks) != 1 || sinks[0] != "syslog" {
+		t.Errorf("Failed ! unexpected sinks %v", sinks)
+	}
+	mylog.Close()
+}
+
+func TestTCPSinkBlocked(t *testing.T) {
+
+	// the collector accepts but never reads
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+
+	mylog, err := NewLogger("testtcpsink", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	tcpSink := NewTCPSink(l.Addr().String(), EncoderText)
+	if err = mylog.AddSink("tcp", tcpSink, LevelInfo); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	start := time.Now()
+	large := strings.Repeat("x", 16<<10)
+	for i := 0; i < 4*SINK_QUEUE_SIZE; i++ {
+		mylog.LogWarn("", "", "%d %s", i, large)
+	}
+	if elapsed := time.Since(start); elapsed > SINK_WRITE_TIMEOUT/2 {
+		t.Errorf("Failed ! logging blocked on the sink for %v", elapsed)
+	}
+	if tcpSink.Dropped() == 0 {
+		t.Errorf("Failed ! expected dropped records")
+	}
+
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed ! sink did not connect")
+	}
+	mylog.Close()
+}
+
+func TestRemoteSink(t *testing.T) {
+
+	// reserve an address, nothing listens on it yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	mylog, err := NewLogger("testremote", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	spool := t.TempDir() + "/testremote.spool"
+	err = mylog.SetLogHostOptions(RemoteOptions{Address: address, SpoolPath: spool,
+		Framing: FramingNewline, Encoder: EncoderJSON, RetryInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	for i := 0; i < 5; i++ {
+		mylog.LogWarn("", "", "spooled %d", i)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(spool); err != nil {
+		t.Fatalf("Failed ! expected spool file %s", err.Error())
+	}
+
+	l, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	defer l.Close()
+	lines := make(chan string, 10)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		scanner := bufio.NewScanner(c)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	mylog.LogWarn("", "", "live")
+
+	for i := 0; i < 6; i++ {
+		select {
+		case line := <-lines:
+			entry := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Failed ! invalid line %s", line)
+			}
+			expected := fmt.Sprintf("spooled %d", i)
+			if i == 5 {
+				expected = "live"
+			}
+			if entry["message"] != expected {
+				t.Errorf("Failed ! got %v expected %s", entry["message"], expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Failed ! timed out waiting for record %d", i)
+		}
+	}
+
+	if err = mylog.SetLogHost(""); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+}
+
+func TestRemoteSinkOrder(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+
+	rs, err := NewRemoteSink(RemoteOptions{Address: l.Addr().String(), SpoolPath: t.TempDir() + "/order.spool",
+		Framing: FramingNewline, Encoder: EncoderText, RetryInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	defer rs.Close()
+	write := func(i int) {
+		rs.WriteRecord(&Record{Time: time.Now(), Level: LevelInfo, Key: "Default",
+			Message: fmt.Sprintf("%d %s", i, strings.Repeat("x", 8<<10))})
+	}
+
+	// the collector does not read, the queue overflows to the spool
+	var c net.Conn
+	select {
+	case c = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed ! sink did not connect")
+	}
+	defer c.Close()
+	count := 0
+	for ; count < 3*REMOTE_QUEUE_SIZE; count++ {
+		write(count)
+	}
+	if _, spooled, _ := rs.Counts(); spooled == 0 {
+		t.Fatalf("Failed ! expected spooled records")
+	}
+
+	// records written once the queue has room follow the spooled ones
+	lines := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(c)
+		scanner.Buffer(make([]byte, 64<<10), 64<<10)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	for ; count < 3*REMOTE_QUEUE_SIZE+100; count++ {
+		write(count)
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case line := <-lines:
+			fields := strings.Fields(line)
+			if len(fields) < 6 || fields[4] != strconv.Itoa(i) {
+				t.Fatalf("Failed ! expected record %d got %.60s", i, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Failed ! timed out waiting for record %d", i)
+		}
+	}
+}
+
+// wait until cond holds or the timeout expires
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestAlarmDelivery(t *testing.T) {
+
+	var requests atomic.Int32
+	ids := make(chan string, 10)
+	received := make(chan AlarmMessage, 10)
+	alarmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg AlarmMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		ids <- msg.Id
+		// fail the first two attempts
+		if requests.Add(1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		received <- msg
+	}))
+	defer alarmServer.Close()
+
+	mylog, err := NewLogger("testalarm", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	if err = mylog.RegisterAlarm("not a url"); err == nil {
+		t.Errorf("Failed ! expected error for invalid endpoint")
+	}
+	err = mylog.RegisterAlarmOptions(alarmServer.URL, AlarmOptions{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	mylog.SetAlarmLabels(map[string]string{"cluster": "east"})
+
+	mylog.LogError("t1", "DCP", "connection lost")
+	select {
+	case msg := <-received:
+		if msg.Module != "testalarm" || msg.Key != "DCP" || msg.TraceId != "t1" || msg.Message != "connection lost" {
+			t.Errorf("Failed ! unexpected alarm %+v", msg)
+		}
+		if msg.Version != ALARM_MESSAGE_VERSION || msg.Severity != "error" || msg.Pid != os.Getpid() ||
+			msg.Hostname == "" || msg.Timestamp.IsZero() || msg.Labels["cluster"] != "east" ||
+			!strings.HasPrefix(msg.Caller, "logger_test.go:") {
+			t.Errorf("Failed ! incomplete alarm %+v", msg)
+		}
+		// retries carry the same id
+		for i := 0; i < 3; i++ {
+			if id := <-ids; id == "" || id != msg.Id {
+				t.Errorf("Failed ! attempt %d has id %s expected %s", i, id, msg.Id)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed ! alarm not delivered")
+	}
+	if !waitFor(time.Second, func() bool { return mylog.AlarmCounts().Delivered == 1 }) {
+		t.Errorf("Failed ! alarm delivery not counted")
+	}
+	if counts := mylog.AlarmCounts(); counts.Retried != 2 || counts.Failed != 0 {
+		t.Errorf("Failed ! unexpected counts %+v", counts)
+	}
+	mylog.ClearAlarm()
+
+	// receivers of the original payload still decode it
+	payload, _ := json.Marshal(AlarmMessage{Module: "m", TraceId: "t", Key: "k", Message: "msg", Version: 2, Pid: 1})
+	var v1 struct{ Module, TraceId, Key, Message string }
+	if err = json.Unmarshal(payload, &v1); err != nil || v1.Module != "m" || v1.Message != "msg" {
+		t.Errorf("Failed ! version 1 decode %v %+v", err, v1)
+	}
+}
+
+func TestAlarmOutbox(t *testing.T) {
+
+	release := make(chan bool)
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slowServer.Close()
+	defer close(release)
+
+	mylog, err := NewLogger("testoutbox", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	outbox := t.TempDir() + "/testoutbox.alarms"
+	opts := AlarmOptions{QueueSize: 1, MaxRetries: -1, OutboxPath: outbox}
+	if err = mylog.RegisterAlarmOptions(slowServer.URL, opts); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	// the endpoint hangs, logging must not
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		mylog.LogError("", "", "alarm %d", i)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Failed ! LogError blocked on a slow endpoint")
+	}
+	// stopping cancels the hung request and moves everything to the outbox
+	mylog.ClearAlarm()
+	if _, err := os.Stat(outbox); err != nil {
+		t.Fatalf("Failed ! expected outbox %s", err.Error())
+	}
+
+	// a new endpoint picks up the outbox
+	received := make(chan AlarmMessage, 10)
+	alarmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg AlarmMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		received <- msg
+	}))
+	defer alarmServer.Close()
+	if err = mylog.RegisterAlarmOptions(alarmServer.URL, opts); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	// the alarm in flight when stopped is persisted last, order is not kept
+	replayed := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		select {
+		case msg := <-received:
+			replayed[msg.Message] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Failed ! timed out waiting for alarm %d", i)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if !replayed[fmt.Sprintf("alarm %d", i)] {
+			t.Errorf("Failed ! alarm %d not replayed", i)
+		}
+	}
+	if !waitFor(time.Second, func() bool { _, err := os.Stat(outbox); return os.IsNotExist(err) }) {
+		t.Errorf("Failed ! outbox not removed after replay")
+	}
+	mylog.ClearAlarm()
+}
+
+func TestAlarmDedupBatch(t *testing.T) {
+
+	received := make(chan []AlarmMessage, 10)
+	alarmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msgs []AlarmMessage
+		json.NewDecoder(r.Body).Decode(&msgs)
+		received <- msgs
+	}))
+	defer alarmServer.Close()
+
+	mylog, err := NewLogger("testdedup", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	opts := AlarmOptions{DedupWindow: 300 * time.Millisecond, BatchSize: 2, BatchDelay: 50 * time.Millisecond,
+		RateLimit: 20}
+	if err = mylog.RegisterAlarmOptions(alarmServer.URL, opts); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	// repeats differ in their arguments but share the format
+	for i := 0; i < 10; i++ {
+		mylog.LogError("", "DCP", "connection to node %d lost", i)
+	}
+	mylog.LogError("", "DCP", "bucket deleted")
+
+	var msgs []AlarmMessage
+	for len(msgs) < 3 {
+		select {
+		case batch := <-received:
+			if len(batch) == 0 || len(batch) > 2 {
+				t.Fatalf("Failed ! unexpected batch size %d", len(batch))
+			}
+			msgs = append(msgs, batch...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Failed ! timed out, received %+v", msgs)
+		}
+	}
+
+	if msgs[0].Message != "connection to node 0 lost" || msgs[0].Count != 1 {
+		t.Errorf("Failed ! unexpected first alarm %+v", msgs[0])
+	}
+	if msgs[1].Message != "bucket deleted" || msgs[1].Count != 1 {
+		t.Errorf("Failed ! unexpected second alarm %+v", msgs[1])
+	}
+	summary := msgs[2]
+	if summary.Message != "connection to node 9 lost" || summary.Count != 9 ||
+		summary.FirstSeen.IsZero() || summary.LastSeen.Before(summary.FirstSeen) {
+		t.Errorf("Failed ! unexpected summary %+v", summary)
+	}
+	if counts := mylog.AlarmCounts(); counts.Suppressed != 9 {
+		t.Errorf("Failed ! unexpected counts %+v", counts)
+	}
+	mylog.ClearAlarm()
+}
+
+func TestAlarmRateLimit(t *testing.T) {
+
+	now := time.Now()
+	rl := &rateLimiter{rate: 10, burst: 2, tokens: 2, last: now}
+	if rl.reserve(now) != 0 || rl.reserve(now) != 0 {
+		t.Errorf("Failed ! burst not allowed")
+	}
+	if d := rl.reserve(now); d != 100*time.Millisecond {
+		t.Errorf("Failed ! expected 100ms wait, got %s", d)
+	}
+	if d := rl.reserve(now.Add(time.Second)); d != 0 {
+		t.Errorf("Failed ! expected no wait after refill, got %s", d)
+	}
+}
+
+func TestAlarmTargets(t *testing.T) {
+
+	newReceiver := func() (*httptest.Server, chan AlarmMessage) {
+		received := make(chan AlarmMessage, 10)
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var msg AlarmMessage
+			json.NewDecoder(r.Body).Decode(&msg)
+			received <- msg
+		})), received
+	}
+	dcpServer, dcpAlarms := newReceiver()
+	defer dcpServer.Close()
+	diskServer, diskAlarms := newReceiver()
+	defer diskServer.Close()
+
+	mylog, err := NewLogger("testtargets", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	err = mylog.AddAlarmTarget("dcp", dcpServer.URL, AlarmRule{MinLevel: LevelWarn, Keys: []string{"DCP"}}, AlarmOptions{})
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.AddAlarmTarget("bad", dcpServer.URL, AlarmRule{Match: "("}, AlarmOptions{}); err == nil {
+		t.Errorf("Failed ! expected error for invalid match")
+	}
+	// added as the socket protocol does
+	spec := fmt.Sprintf(`{"Name":"disk","Endpoint":"%s","ExcludeKeys":["Test"],"Match":"disk .* full"}`, diskServer.URL)
+	if err = setAlarm(mylog, spec); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+
+	mylog.LogWarn("", "DCP", "stream slow")
+	mylog.LogWarn("", "Index", "stream slow")
+	mylog.LogError("", "Index", "disk /data full")
+	mylog.LogError("", "Test", "disk /tmp full")
+	mylog.LogError("", "Index", "query failed")
+
+	expect := func(alarms chan AlarmMessage, message string) {
+		select {
+		case msg := <-alarms:
+			if msg.Message != message {
+				t.Errorf("Failed ! got %s expected %s", msg.Message, message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Failed ! timed out waiting for %s", message)
+		}
+	}
+	expect(dcpAlarms, "stream slow")
+	expect(diskAlarms, "disk /data full")
+	time.Sleep(100 * time.Millisecond)
+	if len(dcpAlarms) != 0 || len(diskAlarms) != 0 {
+		t.Errorf("Failed ! unexpected alarms routed")
+	}
+
+	targets := mylog.AlarmTargets()
+	if len(targets) != 2 || targets[0].Name != "dcp" || targets[0].Level != "warn" || targets[1].Name != "disk" {
+		t.Errorf("Failed ! unexpected targets %+v", targets)
+	}
+	if err = mylog.RemoveAlarmTarget("dcp"); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+	if err = mylog.RemoveAlarmTarget("dcp"); err == nil {
+		t.Errorf("Failed ! expected error removing a missing target")
+	}
+	if !mylog.alarmWanted(LevelError) || mylog.alarmWanted(LevelWarn) {
+		t.Errorf("Failed ! alarm level not updated")
+	}
+
+	// unnamed targets are named after their endpoint, and removed by either
+	if err = mylog.RegisterAlarm(dcpServer.URL); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if targets = mylog.AlarmTargets(); targets[len(targets)-1].Name != AlarmTargetName(dcpServer.URL) ||
+		strings.Contains(targets[len(targets)-1].Name, "/") {
+		t.Errorf("Failed ! unexpected target name %+v", targets)
+	}
+	if err = mylog.RemoveAlarmTarget(dcpServer.URL); err != nil {
+		t.Errorf("Failed ! Error %s", err.Error())
+	}
+	mylog.ClearAlarm()
+	if mylog.alarmWanted(LevelError) {
+		t.Errorf("Failed ! alarms still enabled")
+	}
+}
+
+func TestAlarmFormatters(t *testing.T) {
+
+	type request struct {
+		contentType string
+		body        []byte
+	}
+	received := make(chan request, 10)
+	alarmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{r.Header.Get("Content-Type"), body}
+	}))
+	defer alarmServer.Close()
+
+	mylog, err := NewLogger("testformat", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	mylog.SetAlarmLabels(map[string]string{"cluster": "east"})
+
+	opts := AlarmOptions{Formatter: AlertmanagerFormatter{GeneratorURL: "http://node1:8080/"}}
+	if err = mylog.AddAlarmTarget("am", alarmServer.URL, AlarmRule{}, opts); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	mylog.LogError("t1", "DCP", "connection lost")
+
+	var alerts []struct {
+		Labels       map[string]string
+		Annotations  map[string]string
+		StartsAt     string
+		GeneratorURL string
+	}
+	select {
+	case req := <-received:
+		if err := json.Unmarshal(req.body, &alerts); err != nil || len(alerts) != 1 {
+			t.Fatalf("Failed ! invalid alertmanager body %s", string(req.body))
+		}
+		alert := alerts[0]
+		if alert.Labels["alertname"] != "DCP" || alert.Labels["module"] != "testformat" ||
+			alert.Labels["severity"] != "error" || alert.Labels["cluster"] != "east" ||
+			alert.Annotations["summary"] != "connection lost" || alert.Annotations["traceId"] != "t1" ||
+			alert.StartsAt == "" || alert.GeneratorURL != "http://node1:8080/" {
+			t.Errorf("Failed ! unexpected alert %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed ! alert not delivered")
+	}
+	mylog.ClearAlarm()
+
+	// template selected through the socket protocol
+	spec, _ := json.Marshal(AlarmTargetInfo{Endpoint: alarmServer.URL, Format: "template",
+		Template: `{"text":{{range .Alarms}}{{json (printf "%s: %s" .Key .Message)}}{{end}}}`})
+	if err = setAlarm(mylog, string(spec)); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if targets := mylog.AlarmTargets(); len(targets) != 1 || targets[0].Format != "template" {
+		t.Errorf("Failed ! unexpected targets %+v", targets)
+	}
+	mylog.LogError("", "Index", "disk %s full", "/data")
+	select {
+	case req := <-received:
+		if string(req.body) != `{"text":"Index: disk /data full"}` || req.contentType != "application/json" {
+			t.Errorf("Failed ! unexpected template body %s %s", req.contentType, string(req.body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed ! templated alarm not delivered")
+	}
+	mylog.ClearAlarm()
+
+	if _, err = NewTemplateFormatter("{{.Alarms", ""); err == nil {
+		t.Errorf("Failed ! expected template parse error")
+	}
+	if err = setAlarm(mylog, `{"Endpoint":"exec:/bin/sh"}`); err == nil {
+		t.Errorf("Failed ! exec hooks must not be registered remotely")
+	}
+}
+
+func TestAlarmExecHook(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	mylog, err := NewLogger("testexec", LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	out := t.TempDir() + "/alarm.json"
+	opts := AlarmOptions{Args: []string{"-c", "cat > " + out + ".tmp && mv " + out + ".tmp " + out}}
+	if err = mylog.AddAlarmTarget("hook", "exec:/bin/sh", AlarmRule{}, opts); err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	mylog.LogError("", "DCP", "connection lost")
+
+	var msg AlarmMessage
+	ok := waitFor(5*time.Second, func() bool {
+		data, err := os.ReadFile(out)
+		return err == nil && json.Unmarshal(data, &msg) == nil
+	})
+	if !ok || msg.Message != "connection lost" || msg.Key != "DCP" {
+		t.Errorf("Failed ! hook not run %+v", msg)
+	}
+	mylog.ClearAlarm()
+}
+
+func TestRuntimeDir(t *testing.T) {
+	dir := t.TempDir()
+	mylog, err := NewLoggerOptions("testruntime", LevelInfo, LoggerOptions{RuntimeDir: dir})
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	defer mylog.Close()
+
+	// the socket is registered under the runtime directory
+	if !waitFor(5*time.Second, func() bool {
+		d, err := registry.Lookup(registry.Dir(dir), "testruntime")
+		return err == nil && d.Sockets["log"] != ""
+	}) {
+		t.Errorf("Failed ! module not registered in runtime directory")
+	}
+	if runtime.GOOS != "windows" {
+		if _, err = os.Stat(filepath.Join(dir, "log_testruntime.sock")); err != nil {
+			t.Errorf("Failed ! socket not in runtime directory %s", err.Error())
+		}
+	}
+
+	if err = mylog.SetFile(); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	if mylog.GetFilePath() != dir+pathSeparator()+"testruntime.log" {
+		t.Errorf("Failed ! log file %s not in runtime directory", mylog.GetFilePath())
+	}
+
+	// trace files follow the default path
+	logDir := t.TempDir()
+	if err = mylog.SetDefaultPath(logDir); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	mylog.EnableTraceLogging()
+	defer mylog.DisableTraceLogging()
+	mylog.LogInfo("0x0d1", "", "traced")
+	if _, err = os.Stat(filepath.Join(logDir, "trace_0x0d1.log")); err != nil {
+		t.Errorf("Failed ! trace file not in default path %s", err.Error())
+	}
+	if _, err = os.Stat(filepath.Join(dir, "trace_0x0d1.log")); err == nil {
+		t.Errorf("Failed ! trace file in runtime directory")
+	}
+}
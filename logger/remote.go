@@ -0,0 +1,421 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const REMOTE_SINK_NAME = "remote"
+const REMOTE_QUEUE_SIZE = 1024
+const REMOTE_WRITE_TIMEOUT = 10 * time.Second
+const REMOTE_MIN_RETRY = time.Second
+const REMOTE_MAX_RETRY = time.Minute
+const REMOTE_MAX_SPOOL_SIZE = 64 << 20
+
+type Framing int
+
+const (
+	FramingNewline      Framing = iota // records terminated by '\n'
+	FramingLengthPrefix                // 4 byte big endian length followed by the record
+)
+
+type RemoteOptions struct {
+	Address       string        // host:port of the collector
+	TLSConfig     *tls.Config   // use TLS when not nil
+	Framing       Framing       // record framing on the wire
+	Encoder       Encoder       // record encoding
+	SpoolPath     string        // spool file used while the collector is unavailable
+	MaxSpoolSize  int64         // spooled bytes before records are dropped. Defaults to REMOTE_MAX_SPOOL_SIZE
+	RetryInterval time.Duration // initial reconnect interval, doubled up to REMOTE_MAX_RETRY
+}
+
+// Sink shipping records to a remote collector. Records are spooled to a local
+// file while the collector cannot be reached and replayed once the connection
+// is re-established. Records keep going to the spool until it has been
+// replayed, so the collector receives them in order. Delivery is at least
+// once: a replay that is interrupted is repeated in full on the next
+// connection
+type RemoteSink struct {
+	opts     RemoteOptions
+	cFrame   chan []byte
+	cStop    chan bool
+	done     chan bool
+	mu       sync.RWMutex // guards closed
+	closed   bool
+	spoolMu  sync.Mutex  // guards the spool file and queueing while spooling
+	spooling atomic.Bool // set under spoolMu. The spool holds records not sent yet
+	conn     net.Conn    // owned by the shipping goroutine
+	sent     atomic.Uint64
+	spooled  atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+// Create a remote sink and start shipping in the background
+func NewRemoteSink(opts RemoteOptions) (*RemoteSink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("Required collector address")
+	}
+	if opts.SpoolPath == "" {
+		return nil, fmt.Errorf("Required spool path")
+	}
+	if opts.Framing != FramingNewline && opts.Framing != FramingLengthPrefix {
+		return nil, fmt.Errorf("Invalid framing")
+	}
+	if opts.MaxSpoolSize <= 0 {
+		opts.MaxSpoolSize = REMOTE_MAX_SPOOL_SIZE
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = REMOTE_MIN_RETRY
+	}
+
+	rs := &RemoteSink{opts: opts,
+		cFrame: make(chan []byte, REMOTE_QUEUE_SIZE),
+		cStop:  make(chan bool),
+		done:   make(chan bool),
+	}
+	// left over by an earlier process
+	for _, path := range []string{opts.SpoolPath, rs.replayPath()} {
+		if _, err := os.Stat(path); err == nil {
+			rs.spooling.Store(true)
+		}
+	}
+	go rs.run()
+	return rs, nil
+}
+
+// Ship log records to a remote collector at host:port, encoded as JSON lines.
+// Records are spooled to <log directory>/<module>.spool while the collector is
+// unavailable. An empty host stops shipping
+func (lw *LogWriter) SetLogHost(host string) error {
+	if host == "" {
+		return lw.RemoveSink(REMOTE_SINK_NAME)
+	}
+
+	return lw.SetLogHostOptions(RemoteOptions{
+		Address:   host,
+		Encoder:   EncoderJSON,
+		SpoolPath: lw.logDir() + pathSeparator() + lw.module + ".spool",
+	})
+}
+
+// Ship log records to a remote collector, replacing any previous collector
+func (lw *LogWriter) SetLogHostOptions(opts RemoteOptions) error {
+	rs, err := NewRemoteSink(opts)
+	if err != nil {
+		return err
+	}
+	lw.RemoveSink(REMOTE_SINK_NAME)
+	if err = lw.AddSink(REMOTE_SINK_NAME, rs, LevelDebug); err != nil {
+		rs.Close()
+	}
+	return err
+}
+
+// directory used for the log and trace files
+func (lw *LogWriter) logDir() string {
+	lw.fileMu.RLock()
+	defer lw.fileMu.RUnlock()
+	return lw.logDirLocked()
+}
+
+// Called with fileMu held
+func (lw *LogWriter) logDirLocked() string {
+	if lw.defaultPath == "" {
+		return lw.runtimeDir
+	}
+	return lw.defaultPath
+}
+
+func (rs *RemoteSink) frame(r *Record) []byte {
+	payload := formatRecord(r, rs.opts.Encoder)
+	if rs.opts.Framing == FramingLengthPrefix {
+		frame := make([]byte, 4+len(payload))
+		binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+		copy(frame[4:], payload)
+		return frame
+	}
+	return []byte(payload + "\n")
+}
+
+// queue a record for shipping. Spools directly if the queue is full or
+// earlier records are spooled
+func (rs *RemoteSink) WriteRecord(r *Record) error {
+	frame := rs.frame(r)
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	rs.spoolMu.Lock()
+	defer rs.spoolMu.Unlock()
+	if !rs.closed && !rs.spooling.Load() {
+		select {
+		case rs.cFrame <- frame:
+			return nil
+		default:
+		}
+	}
+	rs.spooling.Store(true)
+	return rs.spool(frame)
+}
+
+// Stop shipping. Queued records are sent, or spooled if not connected
+func (rs *RemoteSink) Close() error {
+	rs.mu.Lock()
+	if rs.closed {
+		rs.mu.Unlock()
+		return nil
+	}
+	rs.closed = true
+	close(rs.cStop)
+	rs.mu.Unlock()
+	<-rs.done
+	return nil
+}
+
+// Number of records sent, spooled and dropped because the spool was full
+func (rs *RemoteSink) Counts() (sent uint64, spooled uint64, dropped uint64) {
+	return rs.sent.Load(), rs.spooled.Load(), rs.dropped.Load()
+}
+
+// spool file being replayed, holding records older than the spool file
+func (rs *RemoteSink) replayPath() string {
+	return rs.opts.SpoolPath + ".replay"
+}
+
+// spooled bytes, called with spoolMu held
+func (rs *RemoteSink) spoolSize() int64 {
+	var size int64
+	for _, path := range []string{rs.opts.SpoolPath, rs.replayPath()} {
+		if fi, err := os.Stat(path); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// append a frame to the spool file, called with spoolMu held
+func (rs *RemoteSink) spool(frame []byte) error {
+	if rs.spoolSize()+int64(len(frame)) > rs.opts.MaxSpoolSize {
+		rs.dropped.Add(1)
+		return fmt.Errorf("Spool file %s full", rs.opts.SpoolPath)
+	}
+
+	fp, err := os.OpenFile(rs.opts.SpoolPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		rs.dropped.Add(1)
+		return err
+	}
+	defer fp.Close()
+	if _, err = fp.Write(frame); err != nil {
+		rs.dropped.Add(1)
+		return err
+	}
+	rs.spooled.Add(1)
+	return nil
+}
+
+// Spool a frame the collector did not get, with the records still queued.
+// They are older than the spooled records and are put ahead of them
+func (rs *RemoteSink) spoolFirst(frame []byte) error {
+	rs.spoolMu.Lock()
+	defer rs.spoolMu.Unlock()
+
+	frames := [][]byte{frame}
+	for drained := false; !drained; {
+		select {
+		case frame := <-rs.cFrame:
+			frames = append(frames, frame)
+		default:
+			drained = true
+		}
+	}
+
+	if !rs.spooling.Swap(true) {
+		for _, frame := range frames {
+			rs.spool(frame)
+		}
+		return nil
+	}
+
+	// write the frames followed by the oldest spooled records to a new
+	// replay file
+	replay := rs.replayPath()
+	if _, err := os.Stat(replay); os.IsNotExist(err) {
+		if err = os.Rename(rs.opts.SpoolPath, replay); err != nil && !os.IsNotExist(err) {
+			rs.dropped.Add(uint64(len(frames)))
+			return err
+		}
+	}
+	tmp := replay + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		rs.dropped.Add(uint64(len(frames)))
+		return err
+	}
+	defer os.Remove(tmp)
+	defer fp.Close()
+
+	size := rs.spoolSize()
+	for _, frame := range frames {
+		if size += int64(len(frame)); size > rs.opts.MaxSpoolSize {
+			rs.dropped.Add(1)
+			continue
+		}
+		if _, err = fp.Write(frame); err != nil {
+			rs.dropped.Add(uint64(len(frames)))
+			return err
+		}
+		rs.spooled.Add(1)
+	}
+	if old, err := os.Open(replay); err == nil {
+		_, err = io.Copy(fp, old)
+		old.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, replay)
+}
+
+// send a spool file to the collector and remove it
+func (rs *RemoteSink) sendFile(path string) error {
+	fp, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	rs.conn.SetWriteDeadline(time.Now().Add(REMOTE_WRITE_TIMEOUT))
+	if _, err = io.Copy(rs.conn, fp); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Send the spooled records to the collector. Records written meanwhile are
+// spooled behind them, and are sent next until the spool is empty
+func (rs *RemoteSink) replaySpool() error {
+	for {
+		if err := rs.sendFile(rs.replayPath()); err != nil {
+			return err
+		}
+
+		rs.spoolMu.Lock()
+		err := os.Rename(rs.opts.SpoolPath, rs.replayPath())
+		if os.IsNotExist(err) {
+			rs.spooling.Store(false)
+		}
+		rs.spoolMu.Unlock()
+
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (rs *RemoteSink) connect() error {
+	dialer := &net.Dialer{Timeout: SINK_DIAL_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if rs.opts.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", rs.opts.Address, rs.opts.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", rs.opts.Address)
+	}
+	if err != nil {
+		return err
+	}
+	rs.conn = conn
+	return nil
+}
+
+func (rs *RemoteSink) disconnect() {
+	if rs.conn != nil {
+		rs.conn.Close()
+		rs.conn = nil
+	}
+}
+
+// send a frame, spooling it if the collector is unavailable. Queued frames
+// are older than the spooled ones and are sent first
+func (rs *RemoteSink) send(frame []byte) {
+	if rs.conn != nil {
+		rs.conn.SetWriteDeadline(time.Now().Add(REMOTE_WRITE_TIMEOUT))
+		if _, err := rs.conn.Write(frame); err == nil {
+			rs.sent.Add(1)
+			return
+		}
+		rs.disconnect()
+	}
+	rs.spoolFirst(frame)
+}
+
+// shipping goroutine. Owns the connection
+func (rs *RemoteSink) run() {
+	defer close(rs.done)
+	defer rs.disconnect()
+
+	retry := rs.opts.RetryInterval
+	nextDial := time.Now()
+	backoff := func() {
+		nextDial = time.Now().Add(retry)
+		if retry *= 2; retry > REMOTE_MAX_RETRY {
+			retry = REMOTE_MAX_RETRY
+		}
+	}
+	ticker := time.NewTicker(rs.opts.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		if rs.conn == nil && !time.Now().Before(nextDial) {
+			if err := rs.connect(); err != nil {
+				backoff()
+			} else {
+				retry = rs.opts.RetryInterval
+			}
+		}
+		// nothing is queued while spooling once the queue is drained
+		if rs.conn != nil && rs.spooling.Load() && len(rs.cFrame) == 0 {
+			if err := rs.replaySpool(); err != nil {
+				rs.disconnect()
+				backoff()
+			}
+		}
+
+		select {
+		case frame := <-rs.cFrame:
+			rs.send(frame)
+		case <-ticker.C:
+		case <-rs.cStop:
+			for {
+				select {
+				case frame := <-rs.cFrame:
+					rs.send(frame)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
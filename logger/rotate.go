@@ -0,0 +1,204 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// suffix appended to rotated log files. Sorts lexically in time order
+const ROTATE_TIME_FORMAT = "20060102T150405.000000000"
+
+type RotationPolicy struct {
+	MaxSize  int64         // rotate when the log file reaches this many bytes, 0 to disable
+	MaxAge   time.Duration // rotate when the log file has been open this long, 0 to disable
+	MaxFiles int           // number of rotated files to retain, 0 to keep all
+	Compress bool          // gzip rotated files
+}
+
+// writer used by the file logger to keep track of the log file size
+type countingWriter struct {
+	lw *LogWriter
+	w  io.Writer
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.lw.fileSize.Add(int64(n))
+	return n, err
+}
+
+// switch the logger to a newly opened log file. Called with fileMu held
+func (lw *LogWriter) setLogFile(fp *os.File) {
+	var size int64
+	if fi, err := fp.Stat(); err == nil {
+		size = fi.Size()
+	}
+	lw.fileSize.Store(size)
+	lw.fileOpened = time.Now()
+	lw.logger = log.New(&countingWriter{lw: lw, w: fp}, "", lw.logFlags())
+}
+
+// Set the automatic rotation policy of the log file. A nil policy disables
+// automatic rotation
+func (lw *LogWriter) SetRotationPolicy(policy *RotationPolicy) error {
+	if policy != nil {
+		if policy.MaxSize < 0 || policy.MaxAge < 0 || policy.MaxFiles < 0 {
+			return fmt.Errorf("Invalid rotation policy")
+		}
+		p := *policy
+		policy = &p
+	}
+	lw.fileMu.Lock()
+	lw.rotation = policy
+	lw.fileMu.Unlock()
+	return nil
+}
+
+// check the rotation policy limits. Called with fileMu held
+func (lw *LogWriter) rotateDue() bool {
+	policy := lw.rotation
+	if policy == nil || lw.file == nil {
+		return false
+	}
+	return (policy.MaxSize > 0 && lw.fileSize.Load() >= policy.MaxSize) ||
+		(policy.MaxAge > 0 && time.Since(lw.fileOpened) >= policy.MaxAge)
+}
+
+// rotate the log file if the rotation policy limits have been reached
+func (lw *LogWriter) checkRotate() {
+	lw.fileMu.RLock()
+	due := lw.rotateDue()
+	lw.fileMu.RUnlock()
+	if !due {
+		return
+	}
+
+	lw.fileMu.Lock()
+	defer lw.fileMu.Unlock()
+	// another writer may have rotated in the meantime
+	if lw.rotateDue() {
+		if err := lw.rotate(); err != nil {
+			fmt.Printf("Logger: Unable to rotate %s, Error %s\n", lw.filePath, err.Error())
+		}
+	}
+}
+
+// Rotate the current log file
+func (lw *LogWriter) Rotate() error {
+	lw.fileMu.Lock()
+	defer lw.fileMu.Unlock()
+	return lw.rotate()
+}
+
+// rotate the log file. Called with fileMu held
+func (lw *LogWriter) rotate() error {
+	if lw.file == nil {
+		return fmt.Errorf("Not logging to a file")
+	}
+
+	filePath := lw.filePath
+	renamePath := filePath + "." + time.Now().UTC().Format(ROTATE_TIME_FORMAT)
+	err := os.Rename(filePath, renamePath)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("Unable to open file %s", err.Error())
+	}
+
+	lw.setLogFile(fp)
+	lw.file.Close()
+	lw.file = fp
+
+	if policy := lw.rotation; policy != nil {
+		if policy.Compress {
+			go func() {
+				if err := compressFile(renamePath); err != nil {
+					fmt.Printf("Logger: Unable to compress %s, Error %s\n", renamePath, err.Error())
+				}
+				pruneRotated(filePath, policy.MaxFiles)
+			}()
+		} else {
+			pruneRotated(filePath, policy.MaxFiles)
+		}
+	}
+
+	return nil
+}
+
+// gzip a rotated file and remove the original
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	src.Close()
+	return os.Remove(path)
+}
+
+// remove the oldest rotated files of filePath so that at most maxFiles remain
+func pruneRotated(filePath string, maxFiles int) {
+	if maxFiles <= 0 {
+		return
+	}
+
+	fileList, err := filepath.Glob(filePath + ".[0-9]*")
+	if err != nil {
+		return
+	}
+
+	// an uncompressed file and its partially written .gz count once
+	rotated := make([]string, 0, len(fileList))
+	for _, fileName := range fileList {
+		if !strings.HasSuffix(fileName, ".gz") {
+			rotated = append(rotated, fileName)
+		} else if _, err := os.Stat(strings.TrimSuffix(fileName, ".gz")); err != nil {
+			rotated = append(rotated, fileName)
+		}
+	}
+
+	if len(rotated) <= maxFiles {
+		return
+	}
+	sort.Strings(rotated)
+	for _, fileName := range rotated[:len(rotated)-maxFiles] {
+		os.Remove(fileName)
+		os.Remove(fileName + ".gz")
+	}
+}
@@ -0,0 +1,457 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SINK_DIAL_TIMEOUT = 5 * time.Second
+const SINK_REDIAL_INTERVAL = time.Second
+const SINK_WRITE_TIMEOUT = 5 * time.Second
+const SINK_QUEUE_SIZE = 1024
+
+// A Sink is an additional destination for log records. Records are handed to
+// every sink attached to a LogWriter whose minimum level they satisfy, after
+// the level and key filters of the LogWriter have been applied
+type Sink interface {
+	WriteRecord(r *Record) error
+	Close() error
+}
+
+type sinkEntry struct {
+	name     string
+	sink     Sink
+	minLevel LogLevel
+	failing  atomic.Bool // last write failed, used to report errors once
+}
+
+// Attach a sink. Only records at minLevel or more severe are written to it
+func (lw *LogWriter) AddSink(name string, sink Sink, minLevel LogLevel) error {
+	if name == "" || sink == nil {
+		return fmt.Errorf("Required sink name and sink")
+	}
+	if minLevel > LevelDebug || minLevel < LevelError {
+		return fmt.Errorf("Invalid sink level")
+	}
+
+	lw.sinkMu.Lock()
+	defer lw.sinkMu.Unlock()
+	for _, se := range lw.sinks {
+		if se.name == name {
+			return fmt.Errorf("Sink %s exists", name)
+		}
+	}
+	lw.sinks = append(lw.sinks, &sinkEntry{name: name, sink: sink, minLevel: minLevel})
+	return nil
+}
+
+// Detach and close a sink
+func (lw *LogWriter) RemoveSink(name string) error {
+	lw.sinkMu.Lock()
+	defer lw.sinkMu.Unlock()
+	for i, se := range lw.sinks {
+		if se.name == name {
+			lw.sinks = append(lw.sinks[:i:i], lw.sinks[i+1:]...)
+			return se.sink.Close()
+		}
+	}
+	return fmt.Errorf("Sink %s not found", name)
+}
+
+// Return the names of the attached sinks
+func (lw *LogWriter) Sinks() []string {
+	lw.sinkMu.RLock()
+	defer lw.sinkMu.RUnlock()
+	names := make([]string, 0, len(lw.sinks))
+	for _, se := range lw.sinks {
+		names = append(names, se.name)
+	}
+	return names
+}
+
+// fan a record out to the attached sinks
+func (lw *LogWriter) writeSinks(r *Record) {
+	lw.sinkMu.RLock()
+	defer lw.sinkMu.RUnlock()
+	for _, se := range lw.sinks {
+		if r.Level > se.minLevel {
+			continue
+		}
+		err := se.sink.WriteRecord(r)
+		if se.failing.Swap(err != nil) == false && err != nil {
+			fmt.Printf("Logger: Unable to write to sink %s, Error %s\n", se.name, err.Error())
+		}
+	}
+}
+
+// close and detach all sinks
+func (lw *LogWriter) closeSinks() {
+	lw.sinkMu.Lock()
+	defer lw.sinkMu.Unlock()
+	for _, se := range lw.sinks {
+		se.sink.Close()
+	}
+	lw.sinks = nil
+}
+
+// render a record as a line for stream sinks, without colour codes
+func formatRecord(r *Record, encoder Encoder) string {
+	if encoder == EncoderJSON {
+		return encodeJSON(r)
+	}
+
+	traceId := r.TraceId
+	if traceId == "" {
+		traceId = "None"
+	}
+	line := fmt.Sprintf("%s %s %s %s %s", r.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		r.Level.String(), r.Key, traceId, r.Message)
+	if len(r.Fields) > 0 {
+		line = line + " " + fieldsText(r.Fields)
+	}
+	return line
+}
+
+// Sink writing newline terminated records to an io.Writer
+type StreamSink struct {
+	mu      sync.Mutex
+	w       io.Writer
+	encoder Encoder
+}
+
+func NewStreamSink(w io.Writer, encoder Encoder) *StreamSink {
+	return &StreamSink{w: w, encoder: encoder}
+}
+
+func NewStderrSink(encoder Encoder) *StreamSink {
+	return NewStreamSink(os.Stderr, encoder)
+}
+
+func (ss *StreamSink) WriteRecord(r *Record) error {
+	line := formatRecord(r, ss.encoder) + "\n"
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	_, err := io.WriteString(ss.w, line)
+	return err
+}
+
+// Closes the underlying writer if it is an io.Closer other than stderr/stdout
+func (ss *StreamSink) Close() error {
+	if ss.w == os.Stderr || ss.w == os.Stdout {
+		return nil
+	}
+	if c, ok := ss.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Open a file sink. Records are appended to path
+func NewFileSink(path string, encoder Encoder) (*StreamSink, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open file %s", err.Error())
+	}
+	return NewStreamSink(fp, encoder), nil
+}
+
+// network connection written from a background goroutine, so that a slow or
+// unreachable endpoint does not hold up logging. Messages are dropped while
+// the queue is full. The connection is re-established after failures
+type netWriter struct {
+	network  string
+	address  string
+	cData    chan []byte
+	cStop    chan bool
+	done     chan bool
+	mu       sync.RWMutex // guards closed
+	closed   bool
+	conn     net.Conn // owned by the writer goroutine
+	lastDial time.Time
+	dropped  atomic.Uint64
+}
+
+func newNetWriter(network string, address string) *netWriter {
+	nw := &netWriter{network: network, address: address,
+		cData: make(chan []byte, SINK_QUEUE_SIZE),
+		cStop: make(chan bool),
+		done:  make(chan bool),
+	}
+	go nw.run()
+	return nw
+}
+
+// queue a message, failing if the queue is full
+func (nw *netWriter) write(data []byte) error {
+	nw.mu.RLock()
+	defer nw.mu.RUnlock()
+	if nw.closed {
+		return fmt.Errorf("Sink %s closed", nw.address)
+	}
+	select {
+	case nw.cData <- data:
+		return nil
+	default:
+		nw.dropped.Add(1)
+		return fmt.Errorf("Queue for %s full", nw.address)
+	}
+}
+
+func (nw *netWriter) dial() error {
+	if time.Since(nw.lastDial) < SINK_REDIAL_INTERVAL {
+		return fmt.Errorf("Not connected to %s", nw.address)
+	}
+	nw.lastDial = time.Now()
+	conn, err := net.DialTimeout(nw.network, nw.address, SINK_DIAL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	nw.conn = conn
+	return nil
+}
+
+// write a message, dialing first unless stopping. Messages are dropped when
+// they cannot be written
+func (nw *netWriter) send(data []byte, stopping bool) error {
+	if nw.conn == nil {
+		if stopping {
+			nw.dropped.Add(1)
+			return nil
+		}
+		if err := nw.dial(); err != nil {
+			nw.dropped.Add(1)
+			return err
+		}
+	}
+	nw.conn.SetWriteDeadline(time.Now().Add(SINK_WRITE_TIMEOUT))
+	if _, err := nw.conn.Write(data); err != nil {
+		nw.conn.Close()
+		nw.conn = nil
+		nw.dropped.Add(1)
+		return err
+	}
+	return nil
+}
+
+// writer goroutine. Owns the connection
+func (nw *netWriter) run() {
+	defer close(nw.done)
+	failing := false
+	report := func(err error) {
+		if !failing && err != nil {
+			fmt.Printf("Logger: Unable to write to %s, Error %s\n", nw.address, err.Error())
+		}
+		failing = err != nil
+	}
+
+	for {
+		select {
+		case data := <-nw.cData:
+			report(nw.send(data, false))
+		case <-nw.cStop:
+			// flush what is queued over the current connection
+			for {
+				select {
+				case data := <-nw.cData:
+					nw.send(data, true)
+				default:
+					if nw.conn != nil {
+						nw.conn.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// stop the writer goroutine once the queued messages are written
+func (nw *netWriter) close() error {
+	nw.mu.Lock()
+	if nw.closed {
+		nw.mu.Unlock()
+		return nil
+	}
+	nw.closed = true
+	close(nw.cStop)
+	nw.mu.Unlock()
+	<-nw.done
+	return nil
+}
+
+// Sink streaming newline delimited records to a TCP endpoint
+type TCPSink struct {
+	nw      *netWriter
+	encoder Encoder
+}
+
+// Create a TCP sink. Records are written from a background goroutine, which
+// connects on the first record and reconnects after failures
+func NewTCPSink(address string, encoder Encoder) *TCPSink {
+	return &TCPSink{nw: newNetWriter("tcp", address), encoder: encoder}
+}
+
+func (ts *TCPSink) WriteRecord(r *Record) error {
+	return ts.nw.write([]byte(formatRecord(r, ts.encoder) + "\n"))
+}
+
+// Number of records dropped because the queue was full or the endpoint failed
+func (ts *TCPSink) Dropped() uint64 {
+	return ts.nw.dropped.Load()
+}
+
+func (ts *TCPSink) Close() error {
+	return ts.nw.close()
+}
+
+const (
+	SyslogFacilityUser   = 1
+	SyslogFacilityDaemon = 3
+	SyslogFacilityLocal0 = 16
+)
+
+type SyslogOptions struct {
+	Network  string // unix, unixgram, udp or tcp. Empty for the local syslog daemon
+	Address  string // address or socket path, ignored for the local daemon
+	AppName  string // APP-NAME, defaults to the process name
+	Facility int    // defaults to SyslogFacilityUser
+}
+
+// Sink writing RFC 5424 messages to a syslog daemon. Stream transports use
+// octet counting framing (RFC 6587)
+type SyslogSink struct {
+	nw       *netWriter
+	stream   bool
+	hostname string
+	appName  string
+	facility int
+}
+
+func NewSyslogSink(opts SyslogOptions) (*SyslogSink, error) {
+	network, address := opts.Network, opts.Address
+	if network == "" {
+		network, address = "unixgram", ""
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			if _, err := os.Stat(path); err == nil {
+				address = path
+				break
+			}
+		}
+		if address == "" {
+			return nil, fmt.Errorf("No local syslog socket found")
+		}
+	}
+
+	switch network {
+	case "unix", "unixgram", "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("Unsupported syslog network %s", network)
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	appName := opts.AppName
+	if appName == "" {
+		appName = os.Args[0]
+		if i := strings.LastIndexAny(appName, `/\`); i >= 0 {
+			appName = appName[i+1:]
+		}
+	}
+	facility := opts.Facility
+	if facility <= 0 || facility > 23 {
+		facility = SyslogFacilityUser
+	}
+
+	return &SyslogSink{
+		nw:       newNetWriter(network, address),
+		stream:   network == "tcp" || network == "unix",
+		hostname: syslogField(hostname, 255),
+		appName:  syslogField(appName, 48),
+		facility: facility,
+	}, nil
+}
+
+// restrict a header field to printable ASCII without spaces
+func syslogField(value string, max int) string {
+	value = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if value == "" {
+		return "-"
+	}
+	if len(value) > max {
+		value = value[:max]
+	}
+	return value
+}
+
+func syslogSeverity(level LogLevel) int {
+	switch level {
+	case LevelError:
+		return 3
+	case LevelWarn:
+		return 4
+	case LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// format a record as an RFC 5424 message
+func (ss *SyslogSink) format(r *Record) string {
+	pri := ss.facility*8 + syslogSeverity(r.Level)
+	msgId := "-"
+	if r.Key != "" {
+		msgId = syslogField(r.Key, 32)
+	}
+
+	traceId := r.TraceId
+	if traceId == "" {
+		traceId = "None"
+	}
+	msg := traceId + " " + r.Message
+	if len(r.Fields) > 0 {
+		msg = msg + " " + fieldsText(r.Fields)
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", pri,
+		r.Time.Format("2006-01-02T15:04:05.000000Z07:00"), ss.hostname, ss.appName,
+		os.Getpid(), msgId, msg)
+}
+
+func (ss *SyslogSink) WriteRecord(r *Record) error {
+	msg := ss.format(r)
+	if ss.stream {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	return ss.nw.write([]byte(msg))
+}
+
+// Number of records dropped because the queue was full or the daemon failed
+func (ss *SyslogSink) Dropped() uint64 {
+	return ss.nw.dropped.Load()
+}
+
+func (ss *SyslogSink) Close() error {
+	return ss.nw.close()
+}
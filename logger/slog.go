@@ -0,0 +1,172 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+const DEFAULT_SLOG_KEY_ATTR = "key"
+const DEFAULT_SLOG_TRACE_ATTR = "traceId"
+
+type SlogOptions struct {
+	KeyAttr   string // attribute holding the component key. Defaults to "key"
+	TraceAttr string // attribute holding the trace id. Defaults to "traceId"
+}
+
+// slog.Handler that routes records into a LogWriter, so that the level, key,
+// trace and alarm controls of the LogWriter apply to slog callers
+type SlogHandler struct {
+	lw      *LogWriter
+	opts    SlogOptions
+	key     string  // component key bound with WithAttrs
+	traceId string  // trace id bound with WithAttrs
+	fields  []Field // attributes bound with WithAttrs
+	group   string  // prefix for attribute names, from WithGroup
+}
+
+// Create a new slog handler backed by lw. opts may be nil
+func NewSlogHandler(lw *LogWriter, opts *SlogOptions) *SlogHandler {
+	h := &SlogHandler{lw: lw}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.KeyAttr == "" {
+		h.opts.KeyAttr = DEFAULT_SLOG_KEY_ATTR
+	}
+	if h.opts.TraceAttr == "" {
+		h.opts.TraceAttr = DEFAULT_SLOG_TRACE_ATTR
+	}
+	return h
+}
+
+// map an slog level to the closest LogLevel
+func slogLevel(level slog.Level) LogLevel {
+	switch {
+	case level >= slog.LevelError:
+		return LevelError
+	case level >= slog.LevelWarn:
+		return LevelWarn
+	case level >= slog.LevelInfo:
+		return LevelInfo
+	}
+	return LevelDebug
+}
+
+func (h *SlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.lw.maxLevel() >= slogLevel(level)
+}
+
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	level := slogLevel(r.Level)
+	key := h.key
+	traceId := h.traceId
+	fields := make([]Field, len(h.fields), len(h.fields)+r.NumAttrs())
+	copy(fields, h.fields)
+
+	r.Attrs(func(a slog.Attr) bool {
+		fields = h.appendAttr(fields, a, &key, &traceId)
+		return true
+	})
+
+	if key == "" {
+		key = "Default"
+	}
+
+	lw := h.lw
+	if lw.keyEnabled(key, level) {
+		entry := &Record{
+			Time:    r.Time,
+			Level:   level,
+			Module:  lw.module,
+			Key:     key,
+			TraceId: traceId,
+			Message: r.Message,
+			Fields:  fields,
+		}
+		if entry.Time.IsZero() {
+			entry.Time = time.Now()
+		}
+		if lw.getEncoder() == EncoderJSON {
+			entry.Caller = pcCaller(r.PC)
+		}
+		lw.writeEntry(entry)
+	}
+
+	if lw.alarmWanted(level) {
+		lw.raiseAlarm(level, traceId, key, r.Message, r.Message, pcCaller(r.PC), fields...)
+	}
+	return nil
+}
+
+// file:line of a slog record's program counter
+func pcCaller(pc uintptr) string {
+	if pc == 0 {
+		return ""
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	return filepath.Base(frame.File) + ":" + strconv.Itoa(frame.Line)
+}
+
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.fields = make([]Field, len(h.fields), len(h.fields)+len(attrs))
+	copy(nh.fields, h.fields)
+	for _, a := range attrs {
+		nh.fields = nh.appendAttr(nh.fields, a, &nh.key, &nh.traceId)
+	}
+	return &nh
+}
+
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	nh := *h
+	nh.group = h.group + name + "."
+	return &nh
+}
+
+// convert an attribute to fields. The key and trace attributes are only
+// recognised outside of groups
+func (h *SlogHandler) appendAttr(fields []Field, a slog.Attr, key *string, traceId *string) []Field {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return fields
+	}
+
+	if h.group == "" {
+		switch a.Key {
+		case h.opts.KeyAttr:
+			*key = a.Value.String()
+			return fields
+		case h.opts.TraceAttr:
+			*traceId = a.Value.String()
+			return fields
+		}
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		gh := *h
+		if a.Key != "" {
+			gh.group = h.group + a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			fields = gh.appendAttr(fields, ga, key, traceId)
+		}
+		return fields
+	}
+
+	return append(fields, Field{Key: h.group + a.Key, Value: a.Value.Any()})
+}
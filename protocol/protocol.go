@@ -0,0 +1,262 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+// Package protocol implements the control protocol spoken on the log and
+// stats sockets of a module. Each message is a JSON document preceded by its
+// length as a 4 byte big endian integer. A client sends one Request and reads
+// one Response; when the response has Stream set, raw content follows it until
+// the connection is closed.
+//
+// The length of a message is below 16MB so the first byte on the wire is
+// always 0. Connections starting with any other byte carry a legacy text
+// command of the form "command:argument", answered with plain text.
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const VERSION = 1
+const MAX_MESSAGE_SIZE = 1<<24 - 1
+const LEGACY_BUFFER_SIZE = 4096
+const REQUEST_TIMEOUT = 30 * time.Second
+
+// Response status codes, following their HTTP counterparts
+const (
+	StatusOK         = 200
+	StatusBadRequest = 400
+	StatusNotFound   = 404
+	StatusError      = 500
+)
+
+type Request struct {
+	Version int      `json:"version"` // 0 for legacy text commands
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type Response struct {
+	Version int             `json:"version"`
+	Status  int             `json:"status"`
+	Error   string          `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Stream  bool            `json:"stream,omitempty"` // raw content follows the response
+	Body    io.Reader       `json:"-"`                // streamed content
+}
+
+// handles a request, returning the response to send
+type Handler func(req *Request) *Response
+
+func NewRequest(command string, args ...string) *Request {
+	return &Request{Version: VERSION, Command: command, Args: args}
+}
+
+// Return argument i, or "" if absent
+func (req *Request) Arg(i int) string {
+	if i < len(req.Args) {
+		return req.Args[i]
+	}
+	return ""
+}
+
+// Successful response carrying data encoded as JSON. nil for no data
+func NewResponse(data interface{}) *Response {
+	resp := &Response{Version: VERSION, Status: StatusOK}
+	if data == nil {
+		return resp
+	}
+	raw, ok := data.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(data); err != nil {
+			return ErrorResponse(StatusError, err)
+		}
+	}
+	resp.Data = raw
+	return resp
+}
+
+func ErrorResponse(status int, err error) *Response {
+	return &Response{Version: VERSION, Status: status, Error: err.Error()}
+}
+
+// Successful response followed by the content of body. body is closed once
+// sent if it is an io.Closer
+func StreamResponse(body io.Reader) *Response {
+	return &Response{Version: VERSION, Status: StatusOK, Stream: true, Body: body}
+}
+
+// Return the error of a failed response, nil if successful
+func (resp *Response) Err() error {
+	if resp.Status == StatusOK {
+		return nil
+	}
+	if resp.Error == "" {
+		return fmt.Errorf("Request failed with status %d", resp.Status)
+	}
+	return errors.New(resp.Error)
+}
+
+// Return Data as text, unquoting JSON strings
+func (resp *Response) Text() string {
+	var text string
+	if json.Unmarshal(resp.Data, &text) == nil {
+		return text
+	}
+	return string(resp.Data)
+}
+
+// Write a length prefixed JSON message
+func WriteMessage(w io.Writer, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MAX_MESSAGE_SIZE {
+		return fmt.Errorf("Message size %d exceeds %d", len(payload), MAX_MESSAGE_SIZE)
+	}
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err = w.Write(frame)
+	return err
+}
+
+// Read a length prefixed JSON message into v
+func ReadMessage(r io.Reader, v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MAX_MESSAGE_SIZE {
+		return fmt.Errorf("Message size %d exceeds %d", size, MAX_MESSAGE_SIZE)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// Send a request and read the response. The content of a streamed response is
+// left on the connection as resp.Body
+func Call(c net.Conn, req *Request) (*Response, error) {
+	if req.Version == 0 {
+		req.Version = VERSION
+	}
+	if err := WriteMessage(c, req); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp := &Response{}
+	if err := ReadMessage(br, resp); err != nil {
+		return nil, err
+	}
+	if resp.Stream {
+		resp.Body = br
+	}
+	return resp, nil
+}
+
+// Map a legacy command name to one of commands. Legacy names were matched by
+// substring, commands is ordered so that e.g. "traceoff" precedes "trace"
+func LegacyCommand(name string, commands []string) string {
+	name = strings.ToLower(name)
+	for _, cmd := range commands {
+		if strings.Contains(name, cmd) {
+			return cmd
+		}
+	}
+	return name
+}
+
+// Read one request from a connection, framed or legacy, and send the
+// response of handler
+func Serve(c net.Conn, handler Handler) error {
+	c.SetReadDeadline(time.Now().Add(REQUEST_TIMEOUT))
+	br := bufio.NewReaderSize(c, LEGACY_BUFFER_SIZE)
+	first, err := br.Peek(1)
+	if err != nil {
+		return err
+	}
+	if first[0] != 0 {
+		return serveLegacy(c, br, handler)
+	}
+
+	req := &Request{}
+	if err = ReadMessage(br, req); err != nil {
+		WriteMessage(c, ErrorResponse(StatusBadRequest, err))
+		return err
+	}
+	c.SetReadDeadline(time.Time{})
+
+	var resp *Response
+	if req.Version < 1 || req.Version > VERSION {
+		resp = ErrorResponse(StatusBadRequest, fmt.Errorf("Unsupported protocol version %d", req.Version))
+	} else {
+		resp = handler(req)
+	}
+	return writeResponse(c, resp)
+}
+
+func writeResponse(c net.Conn, resp *Response) error {
+	if closer, ok := resp.Body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	resp.Version = VERSION
+	resp.Stream = resp.Body != nil
+	if err := WriteMessage(c, resp); err != nil {
+		return err
+	}
+	if resp.Body != nil {
+		_, err := io.Copy(c, resp.Body)
+		return err
+	}
+	return nil
+}
+
+// legacy commands are sent in a single write and answered with text
+func serveLegacy(c net.Conn, br *bufio.Reader, handler Handler) error {
+	buf := make([]byte, LEGACY_BUFFER_SIZE)
+	nr, err := br.Read(buf)
+	if err != nil {
+		return err
+	}
+	c.SetReadDeadline(time.Time{})
+
+	cmds := strings.SplitN(string(buf[:nr]), ":", 2)
+	req := &Request{Command: cmds[0]}
+	if len(cmds) > 1 {
+		req.Args = []string{cmds[1]}
+	}
+
+	resp := handler(req)
+	if closer, ok := resp.Body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	switch {
+	case resp.Status != StatusOK:
+		_, err = io.WriteString(c, resp.Err().Error())
+	case resp.Body != nil:
+		_, err = io.Copy(c, resp.Body)
+	case len(resp.Data) == 0:
+		_, err = io.WriteString(c, "OK")
+	default:
+		_, err = io.WriteString(c, resp.Text())
+	}
+	return err
+}
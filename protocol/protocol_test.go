@@ -0,0 +1,103 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testHandler(req *Request) *Response {
+	switch req.Command {
+	case "echo":
+		return NewResponse(req.Args)
+	case "ok":
+		return NewResponse(nil)
+	case "file":
+		return StreamResponse(strings.NewReader(strings.Repeat("x", 100000)))
+	}
+	return ErrorResponse(StatusNotFound, fmt.Errorf("Unknown command %s", req.Command))
+}
+
+// serve one connection with testHandler
+func pipe() net.Conn {
+	server, client := net.Pipe()
+	go func() {
+		Serve(server, testHandler)
+		server.Close()
+	}()
+	return client
+}
+
+func TestFramed(t *testing.T) {
+
+	c := pipe()
+	resp, err := Call(c, NewRequest("echo", "a:b", "c"))
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if resp.Status != StatusOK || resp.Version != VERSION || string(resp.Data) != `["a:b","c"]` {
+		t.Errorf("Failed ! unexpected response %+v", resp)
+	}
+	c.Close()
+
+	c = pipe()
+	resp, err = Call(c, NewRequest("missing"))
+	if err != nil {
+		t.Fatalf("Failed ! Error %s", err.Error())
+	}
+	if resp.Status != StatusNotFound || resp.Err() == nil {
+		t.Errorf("Failed ! expected not found %+v", resp)
+	}
+	c.Close()
+
+	c = pipe()
+	resp, err = Call(c, &Request{Version: VERSION + 1, Command: "ok"})
+	if err != nil || resp.Status != StatusBadRequest {
+		t.Errorf("Failed ! expected unsupported version %v %+v", err, resp)
+	}
+	c.Close()
+
+	// large streamed responses are not truncated
+	c = pipe()
+	resp, err = Call(c, NewRequest("file"))
+	if err != nil || !resp.Stream {
+		t.Fatalf("Failed ! expected stream %v %+v", err, resp)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if len(data) != 100000 {
+		t.Errorf("Failed ! streamed %d bytes", len(data))
+	}
+	c.Close()
+}
+
+func TestLegacy(t *testing.T) {
+
+	for _, tc := range []struct{ request, reply string }{
+		{"ok:", "OK"},
+		{"echo:a:b", `["a:b"]`},
+		{"missing:", "Unknown command missing"},
+	} {
+		c := pipe()
+		c.Write([]byte(tc.request))
+		reply, _ := io.ReadAll(c)
+		if string(reply) != tc.reply {
+			t.Errorf("Failed ! %s replied %s expected %s", tc.request, string(reply), tc.reply)
+		}
+		c.Close()
+	}
+
+	commands := []string{"traceoff", "trace"}
+	if LegacyCommand("traceOff", commands) != "traceoff" || LegacyCommand("trace", commands) != "trace" {
+		t.Errorf("Failed ! legacy command mapping")
+	}
+}
@@ -6,13 +6,19 @@
 //  software will be governed by the Apache License, Version 2.0, included in
 //  the file licenses/APL2.txt.
 
-package main
+// +build !windows
+
+package registry
 
 import (
-	"github.com/natefinch/npipe"
-	"net"
+	"syscall"
 )
 
-func connect(pathName string) (net.Conn, error) {
-	return npipe.Dial(pathName)
+// check if a process exists. EPERM means it exists but belongs to another user
+func alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
 }
@@ -0,0 +1,34 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package registry
+
+import (
+	"syscall"
+)
+
+const PROCESS_QUERY_LIMITED_INFORMATION = 0x1000
+const STILL_ACTIVE = 259
+
+// check if a process exists and has not exited
+func alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	h, err := syscall.OpenProcess(PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// access denied means the process exists
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err = syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == STILL_ACTIVE
+}
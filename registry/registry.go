@@ -0,0 +1,195 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+// Package registry records the modules running on a host. Each module has a
+// JSON descriptor in the registry directory, written atomically when its
+// logger or stats collector starts listening. Descriptors of processes that
+// are no longer running are detected by pid and removed when listing
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/retriever/protocol"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registry directory inside a runtime directory
+const REGISTRY_DIR = "retriever_modules"
+
+type Descriptor struct {
+	Name         string              `json:"name"`
+	Pid          int                 `json:"pid"`
+	StartTime    time.Time           `json:"startTime"`
+	Version      int                 `json:"version"`                // control protocol version
+	Sockets      map[string]string   `json:"sockets"`                // socket or pipe path by kind, log or stats
+	Capabilities map[string][]string `json:"capabilities,omitempty"` // commands by socket kind
+	LogDir       string              `json:"logDir,omitempty"`       // directory of the log and trace files
+}
+
+// serialises read-modify-write of descriptors within the process
+var mu sync.Mutex
+
+var startTime = time.Now()
+
+// Registry directory of a runtime directory
+func Dir(runtimeDir string) string {
+	return filepath.Join(runtimeDir, REGISTRY_DIR)
+}
+
+func descriptorPath(dir string, name string) string {
+	return filepath.Join(dir, name+".json")
+}
+
+func read(path string) (*Descriptor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &Descriptor{}
+	if err = json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// write a descriptor through a temporary file so readers never see a partial one
+func write(dir string, d *Descriptor) error {
+	data, err := json.MarshalIndent(d, "", "    ")
+	if err != nil {
+		return err
+	}
+	fp, err := os.CreateTemp(dir, "."+d.Name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(data)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), descriptorPath(dir, d.Name))
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+	}
+	return err
+}
+
+// Record a socket of a module run by this process. A descriptor left by a
+// previous process of the same name is replaced
+func Register(dir string, kind string, name string, socket string, commands []string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("Invalid module name %q", name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	d, err := read(descriptorPath(dir, name))
+	if err != nil || d.Pid != os.Getpid() {
+		d = &Descriptor{Name: name, Pid: os.Getpid(), StartTime: startTime}
+	}
+	d.Version = protocol.VERSION
+	if d.Sockets == nil {
+		d.Sockets = make(map[string]string)
+	}
+	d.Sockets[kind] = socket
+	if d.Capabilities == nil {
+		d.Capabilities = make(map[string][]string)
+	}
+	d.Capabilities[kind] = commands
+	return write(dir, d)
+}
+
+// Record the directory of the log and trace files of a module run by this
+// process. Ignored until one of its sockets is registered
+func SetLogDir(dir string, name string, logDir string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	d, err := read(descriptorPath(dir, name))
+	if err != nil || d.Pid != os.Getpid() || d.LogDir == logDir {
+		return nil
+	}
+	d.LogDir = logDir
+	return write(dir, d)
+}
+
+// Remove a socket of a module run by this process, and the descriptor once
+// it has no sockets left
+func Unregister(dir string, kind string, name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	path := descriptorPath(dir, name)
+	d, err := read(path)
+	if err != nil || d.Pid != os.Getpid() {
+		return err
+	}
+	delete(d.Sockets, kind)
+	delete(d.Capabilities, kind)
+	if len(d.Sockets) == 0 {
+		return os.Remove(path)
+	}
+	return write(dir, d)
+}
+
+// Return the descriptors of the running modules sorted by name. Descriptors
+// of exited processes are removed
+func List(dir string) ([]Descriptor, error) {
+	fileList, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	modules := make([]Descriptor, 0, len(fileList))
+	for _, fileName := range fileList {
+		d, err := read(fileName)
+		if err != nil {
+			continue
+		}
+		if !alive(d.Pid) {
+			removeStale(fileName, d.Pid)
+			continue
+		}
+		modules = append(modules, *d)
+	}
+	sort.Slice(modules, func(i, j int) bool { return modules[i].Name < modules[j].Name })
+	return modules, nil
+}
+
+// Return the descriptor of a running module
+func Lookup(dir string, name string) (*Descriptor, error) {
+	d, err := read(descriptorPath(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("Module %s not registered", name)
+	}
+	if !alive(d.Pid) {
+		removeStale(descriptorPath(dir, name), d.Pid)
+		return nil, fmt.Errorf("Module %s not running", name)
+	}
+	return d, nil
+}
+
+// remove a stale descriptor unless it has been replaced in the meantime
+func removeStale(path string, pid int) {
+	mu.Lock()
+	defer mu.Unlock()
+	if d, err := read(path); err == nil && d.Pid == pid {
+		os.Remove(path)
+	}
+}
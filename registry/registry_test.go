@@ -0,0 +1,105 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	dir := Dir(t.TempDir())
+
+	if err := Register(dir, "log", "indexer", "/tmp/log_indexer.sock", []string{"level"}); err != nil {
+		t.Fatalf("Register failed %v", err)
+	}
+	if err := Register(dir, "stats", "indexer", "/tmp/stats_indexer.sock", []string{"stats"}); err != nil {
+		t.Fatalf("Register failed %v", err)
+	}
+	if err := Register(dir, "log", "../query", "/tmp/x.sock", nil); err == nil {
+		t.Errorf("Expected invalid module name")
+	}
+
+	d, err := Lookup(dir, "indexer")
+	if err != nil {
+		t.Fatalf("Lookup failed %v", err)
+	}
+	if d.Pid != os.Getpid() || d.Sockets["log"] != "/tmp/log_indexer.sock" ||
+		d.Sockets["stats"] != "/tmp/stats_indexer.sock" || d.Capabilities["stats"][0] != "stats" {
+		t.Errorf("Unexpected descriptor %+v", d)
+	}
+
+	if err = SetLogDir(dir, "indexer", "/var/log/indexer"); err != nil {
+		t.Fatalf("SetLogDir failed %v", err)
+	}
+	if d, _ = Lookup(dir, "indexer"); d == nil || d.LogDir != "/var/log/indexer" {
+		t.Errorf("Expected log directory %+v", d)
+	}
+
+	// no temporary files left behind
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Errorf("Expected one descriptor, found %v", files)
+	}
+
+	if err = Unregister(dir, "log", "indexer"); err != nil {
+		t.Fatalf("Unregister failed %v", err)
+	}
+	if d, _ = Lookup(dir, "indexer"); d == nil || d.Sockets["log"] != "" {
+		t.Errorf("Expected stats socket only %+v", d)
+	}
+	Unregister(dir, "stats", "indexer")
+	if _, err = Lookup(dir, "indexer"); err == nil {
+		t.Errorf("Expected descriptor removed")
+	}
+}
+
+func TestStale(t *testing.T) {
+	dir := Dir(t.TempDir())
+	Register(dir, "log", "indexer", "/tmp/log_indexer.sock", nil)
+
+	// descriptor left by a process that exited
+	stale := &Descriptor{Name: "query", Pid: 1 << 30, StartTime: time.Now(),
+		Sockets: map[string]string{"log": "/tmp/log_query.sock"}}
+	if err := write(dir, stale); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+
+	modules, err := List(dir)
+	if err != nil {
+		t.Fatalf("List failed %v", err)
+	}
+	if len(modules) != 1 || modules[0].Name != "indexer" {
+		t.Errorf("Expected indexer only %+v", modules)
+	}
+	if _, err = os.Stat(descriptorPath(dir, "query")); !os.IsNotExist(err) {
+		t.Errorf("Expected stale descriptor removed")
+	}
+
+	// a new process replaces the descriptor of a previous one
+	write(dir, &Descriptor{Name: "indexer", Pid: 1 << 30, Sockets: map[string]string{"stats": "old"}})
+	Register(dir, "log", "indexer", "/tmp/log_indexer.sock", nil)
+	d, err := Lookup(dir, "indexer")
+	if err != nil || d.Pid != os.Getpid() || d.Sockets["stats"] != "" {
+		t.Errorf("Expected replaced descriptor %+v %v", d, err)
+	}
+}
+
+func TestPipeName(t *testing.T) {
+	if name := PipeName(systemDir(), "log_indexer"); name != PIPE_PATH+"log_indexer.pipe" {
+		t.Errorf("Unexpected pipe %s", name)
+	}
+	a, b := PipeName("/run/a", "log_indexer"), PipeName("/run/b", "log_indexer")
+	if a == b || !strings.HasSuffix(a, "_log_indexer.pipe") {
+		t.Errorf("Expected distinct pipes per runtime directory %s %s", a, b)
+	}
+}
@@ -0,0 +1,52 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package registry
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// environment variable selecting the runtime directory of sockets, registry,
+// log and trace files
+const RUNTIME_DIR_ENV = "RETRIEVER_RUNTIME_DIR"
+
+const PIPE_PATH = `\\.\pipe\`
+
+func systemDir() string {
+	if runtime.GOOS == "windows" {
+		return os.Getenv("tmp")
+	} else {
+		return "/tmp"
+	}
+}
+
+// Return the runtime directory used when none is configured, from
+// RETRIEVER_RUNTIME_DIR or else the temporary directory of the system
+func DefaultRuntimeDir() string {
+	if dir := os.Getenv(RUNTIME_DIR_ENV); dir != "" {
+		return dir
+	}
+	return systemDir()
+}
+
+// Return the named pipe of a socket name e.g. log_<module>. Pipes share one
+// namespace, so pipes of a runtime directory other than the system one are
+// qualified by a hash of the directory
+func PipeName(runtimeDir string, name string) string {
+	if runtimeDir == "" || filepath.Clean(runtimeDir) == filepath.Clean(systemDir()) {
+		return PIPE_PATH + name + ".pipe"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(filepath.Clean(runtimeDir)))
+	return fmt.Sprintf("%sretriever_%08x_%s.pipe", PIPE_PATH, h.Sum32(), name)
+}
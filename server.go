@@ -9,33 +9,127 @@
 package main
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
+	"github.com/couchbase/retriever/client"
 	"github.com/couchbase/retriever/logger"
 	"github.com/gorilla/mux"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-var rl logger.LogWriter
+var rl *logger.LogWriter
+var cl *client.Client
 
 const DEFAULT = "Retriever"
 const LOGGER = "Logger"
 
 func main() {
 
-	r := mux.NewRouter()
-	r.HandleFunc("/logger/{module}", HandleLoggerCmds).Methods("GET", "PUT", "POST")
-	r.HandleFunc("/stats/{module}", HandleStatsCmds).Methods("GET", "PUT", "POST")
-	http.Handle("/", r)
+	cmd, err := parseFlags(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+	if cmd.hashPassword {
+		printPasswordHash()
+		return
+	}
+	cfg, err := loadConfig(cmd.configFile, cmd.apply)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration\n%s\n", err.Error())
+		os.Exit(2)
+	}
+	currentConfig.Store(cfg)
+	cl = &client.Client{Dir: cfg.RuntimeDir, Timeout: time.Duration(cfg.Timeouts.Module)}
 
-	rl, err := logger.NewLogger(DEFAULT, logger.LevelDebug)
+	level, _ := logger.ParseLogLevel(cfg.LogLevel)
+	rl, err = logger.NewLoggerOptions(cfg.LogModule, level, logger.LoggerOptions{RuntimeDir: cfg.RuntimeDir})
 	if err != nil {
 		panic_msg := fmt.Sprintf("Cannot intialize logger %s", err.Error())
 		panic(panic_msg)
 	}
 	rl.SetFile()
-	rl.EnableKeys([]string{DEFAULT, LOGGER, "Stats"})
+	rl.EnableKeys(cfg.LogKeys)
+
+	if cfg.authenticator == nil {
+		rl.LogWarn("", DEFAULT, "Authentication disabled, configure auth tokensFile or credentialsFile")
+	}
+
+	go handleReload(cmd)
+
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           newHandler(),
+		ReadHeaderTimeout: time.Duration(cfg.Timeouts.ReadHeader),
+		ReadTimeout:       time.Duration(cfg.Timeouts.Read),
+		WriteTimeout:      time.Duration(cfg.Timeouts.Write),
+		IdleTimeout:       time.Duration(cfg.Timeouts.Idle),
+	}
+
+	rl.LogInfo("", DEFAULT, "Retriever Server started on %s", cfg.Listen)
 
-	rl.LogInfo("", DEFAULT, "Retriever Server started")
+	if cfg.TLS.CertFile != "" {
+		tr := newTLSReloader()
+		if _, err = tr.current(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid TLS configuration\n%s\n", err.Error())
+			os.Exit(2)
+		}
+		srv.TLSConfig = tr.serverConfig()
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	rl.LogError("", DEFAULT, "Retriever Server stopped %s", err.Error())
+	os.Exit(1)
+}
+
+// routes of the REST API, behind authentication
+func newHandler() http.Handler {
+	// path variables such as trace ids are validated by the handlers, not
+	// redirected to a cleaned path
+	r := mux.NewRouter().SkipClean(true)
+	routeAPIv2(r)
+	r.HandleFunc("/logger/{module}", HandleLoggerCmds).Methods("GET", "PUT", "POST")
+	r.HandleFunc("/stats/{module}", HandleStatsCmds).Methods("GET", "PUT", "POST")
+	r.HandleFunc("/modules", HandleModules).Methods("GET")
+	r.HandleFunc("/files", HandleFiles).Methods("GET")
+	return authenticate(r)
+}
 
-	http.ListenAndServe(":8080", nil)
+// reload the configuration on SIGHUP. An invalid configuration is reported
+// and the current one kept
+func handleReload(cmd *cmdLine) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		cfg, err := loadConfig(cmd.configFile, cmd.apply)
+		if err != nil {
+			rl.LogError("", DEFAULT, "Configuration not reloaded %s", err.Error())
+			continue
+		}
+		reloadConfig(cfg)
+	}
+}
+
+// read a password from stdin and print its hash for the credentials file
+func printPasswordHash() {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	hash, err := hashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(hash)
 }
@@ -0,0 +1,47 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"github.com/couchbase/retriever/client"
+	"github.com/couchbase/retriever/logger"
+	"os"
+	"testing"
+	"time"
+)
+
+// runtime directory of the test modules
+var testDir string
+
+func TestMain(m *testing.M) {
+	var err error
+	if testDir, err = os.MkdirTemp("", "retriever"); err != nil {
+		panic(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.RuntimeDir = testDir
+	currentConfig.Store(cfg)
+	cl = &client.Client{Dir: testDir, Timeout: 5 * time.Second}
+	rl, err = logger.NewLoggerOptions("testretriever", logger.LevelError, logger.LoggerOptions{RuntimeDir: testDir})
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+// install a configuration for the duration of a test
+func setConfig(t *testing.T, cfg *Config) {
+	old := config()
+	currentConfig.Store(cfg)
+	t.Cleanup(func() { currentConfig.Store(old) })
+}
@@ -12,16 +12,18 @@ package stats
 
 import (
 	"fmt"
+	"github.com/couchbase/retriever/protocol"
+	"github.com/couchbase/retriever/registry"
 	"net"
 	"os"
-	"strings"
+	"path/filepath"
 )
 
 func handleConnections(sc *StatsCollector) {
 
 	// create an I/O channel based on the module name
 	// for the server to connect to
-	sock := "/tmp/" + "stats_" + sc.Module + ".sock"
+	sock := filepath.Join(sc.runtimeDir, "stats_"+sc.Module+".sock")
 	os.Remove(sock)
 	listener, err := net.Listen("unix", sock)
 
@@ -32,27 +34,20 @@ func handleConnections(sc *StatsCollector) {
 	defer os.Remove(sock)
 	defer listener.Close()
 
+	// let clients discover the socket
+	regDir := registry.Dir(sc.runtimeDir)
+	if err = registry.Register(regDir, "stats", sc.Module, sock, statsCommands); err != nil {
+		fmt.Printf("Unable to register module %s\n", err.Error())
+	}
+	defer registry.Unregister(regDir, "stats", sc.Module)
+
 	for {
 		c, err := listener.Accept()
 		if err != nil {
 			fmt.Printf("Unable to accept " + err.Error())
 			continue
 		}
-		buf := make([]byte, 512)
-		nr, err := c.Read(buf)
-		if err != nil {
-			fmt.Printf(" Could not read from buffer %s", err.Error())
-			c.Close()
-			continue
-		}
-		data := string(buf[0:nr])
-		cmds := strings.Split(data, ":")
-		switch {
-		case strings.Contains(strings.ToLower(cmds[0]), "stats"):
-			// rotate the current log file
-			statsOutput := sc.GetAllStat()
-			c.Write([]byte(statsOutput))
-		}
+		protocol.Serve(c, sc.handleRequest)
 		c.Close()
 	}
 }
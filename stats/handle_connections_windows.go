@@ -10,19 +10,19 @@ package stats
 
 import (
 	"fmt"
+	"github.com/couchbase/retriever/protocol"
+	"github.com/couchbase/retriever/registry"
 	"github.com/natefinch/npipe"
-	"log"
 	"os"
-	"strings"
 )
 
-const DEFAULT_PIPE_PATH = `\\.\pipe\`
+const DEFAULT_PIPE_PATH = registry.PIPE_PATH
 
 func handleConnections(sc *StatsCollector) {
 
 	// create an I/O channel based on the module name
 	// for the server to connect to
-	pipe := DEFAULT_PIPE_PATH + "stats_" + sc.Module + ".pipe"
+	pipe := registry.PipeName(sc.runtimeDir, "stats_"+sc.Module)
 	os.Remove(pipe)
 	listener, err := npipe.Listen(pipe)
 
@@ -33,18 +33,12 @@ func handleConnections(sc *StatsCollector) {
 	defer os.Remove(pipe)
 	defer listener.Close()
 
-	// create a file entry for the pipe in the default pathname so that clients
-	// can discover the pipe entry
-	pipeEntry := getDefaultPath() + "/stats_" + sc.Module + ".sock"
-	os.Remove(pipeEntry)
-
-	fp, err := os.OpenFile(pipeEntry, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatal("Unable to open file %s", err.Error())
+	// let clients discover the pipe
+	regDir := registry.Dir(sc.runtimeDir)
+	if err = registry.Register(regDir, "stats", sc.Module, pipe, statsCommands); err != nil {
+		fmt.Printf("Unable to register module %s\n", err.Error())
 	}
-
-	defer fp.Close()
-	defer os.Remove(pipeEntry)
+	defer registry.Unregister(regDir, "stats", sc.Module)
 
 	for {
 		c, err := listener.Accept()
@@ -52,21 +46,7 @@ func handleConnections(sc *StatsCollector) {
 			fmt.Printf("Unable to accept " + err.Error())
 			continue
 		}
-		buf := make([]byte, 512)
-		nr, err := c.Read(buf)
-		if err != nil {
-			fmt.Printf(" Could not read from buffer %s", err.Error())
-			c.Close()
-			continue
-		}
-		data := string(buf[0:nr])
-		cmds := strings.Split(data, ":")
-		switch {
-		case strings.Contains(strings.ToLower(cmds[0]), "stats"):
-			// rotate the current log file
-			statsOutput := sc.GetAllStat()
-			c.Write([]byte(statsOutput))
-		}
+		protocol.Serve(c, sc.handleRequest)
 		c.Close()
 	}
 }
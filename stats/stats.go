@@ -11,8 +11,10 @@ package stats
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"github.com/couchbase/retriever/protocol"
+	"github.com/couchbase/retriever/registry"
 	"runtime"
+	"strings"
 	"sync"
 )
 
@@ -41,30 +43,38 @@ type processStats struct {
 	GcNum  uint32 `json:"gc_num"`
 }
 
-func getDefaultPath() string {
-	if runtime.GOOS == "windows" {
-		return os.Getenv("tmp")
-	} else {
-		return "/tmp"
-	}
+type StatsCollector struct {
+	Module     string
+	SysStats   *processStats
+	Stats      map[string]interface{}
+	mu         sync.RWMutex
+	statFuncs  map[string]func() interface{} // stats computed when read
+	runtimeDir string                        // directory of the control socket
 }
 
-type StatsCollector struct {
-	Module   string
-	SysStats *processStats
-	Stats    map[string]interface{}
-	mu       sync.RWMutex
+type StatsOptions struct {
+	RuntimeDir string // control socket and registry. Defaults to registry.DefaultRuntimeDir()
 }
 
 func NewStatsCollector(module string) (*StatsCollector, error) {
+	return NewStatsCollectorOptions(module, StatsOptions{})
+}
+
+// Create a stats collector using the given runtime directory
+func NewStatsCollectorOptions(module string, opts StatsOptions) (*StatsCollector, error) {
 
 	if module == "" {
 		return nil, fmt.Errorf("Required module name")
 	}
+	if opts.RuntimeDir == "" {
+		opts.RuntimeDir = registry.DefaultRuntimeDir()
+	}
 
 	sc := &StatsCollector{Module: module,
-		SysStats: &processStats{},
-		Stats:    make(map[string]interface{}),
+		runtimeDir: opts.RuntimeDir,
+		SysStats:   &processStats{},
+		Stats:      make(map[string]interface{}),
+		statFuncs:  make(map[string]func() interface{}),
 	}
 	go handleConnections(sc)
 	return sc, nil
@@ -87,6 +97,27 @@ func (sc *StatsCollector) AddStatKey(key string, initial interface{}) error {
 	return nil
 }
 
+// Add a stat whose value is computed by fn each time it is read
+func (sc *StatsCollector) AddStatFunc(key string, fn func() interface{}) error {
+
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+	if fn == nil {
+		return fmt.Errorf("stat function cannot be nil")
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	_, ok := sc.Stats[key]
+	if ok { // key already exists
+		return fmt.Errorf("key exists")
+	}
+	// fn is only called when the stat is read, never with the lock held
+	sc.statFuncs[key] = fn
+	sc.Stats[key] = nil
+	return nil
+}
+
 func (sc *StatsCollector) UpdateStat(key string, value interface{}) error {
 	if key == "" {
 		return fmt.Errorf("key cannot be empty ")
@@ -188,8 +219,12 @@ func (sc *StatsCollector) DecrementStat(key string) error {
 
 func (sc *StatsCollector) GetStat(key string) interface{} {
 	sc.mu.RLock()
-	defer sc.mu.RUnlock()
+	fn, isFunc := sc.statFuncs[key]
 	value, ok := sc.Stats[key]
+	sc.mu.RUnlock()
+	if isFunc {
+		return fn()
+	}
 	if !ok {
 		return nil
 	}
@@ -225,7 +260,25 @@ func (sc *StatsCollector) GetAllStat() string {
 		GcNum:  mem.NumGC,
 	}
 
+	sc.mu.RLock()
+	funcs := make(map[string]func() interface{}, len(sc.statFuncs))
+	for key, fn := range sc.statFuncs {
+		funcs[key] = fn
+	}
+	sc.mu.RUnlock()
+	values := make(map[string]interface{}, len(funcs))
+	for key, fn := range funcs {
+		values[key] = fn()
+	}
+	sc.mu.Lock()
+	for key, value := range values {
+		sc.Stats[key] = value
+	}
+	sc.mu.Unlock()
+
+	sc.mu.RLock()
 	jsonBytes, jsonErr := json.MarshalIndent(sc, "", "    ")
+	sc.mu.RUnlock()
 	var body string
 	if jsonErr != nil {
 		body = jsonErr.Error()
@@ -235,3 +288,23 @@ func (sc *StatsCollector) GetAllStat() string {
 
 	return body
 }
+
+// commands of the stats socket, in the order legacy text commands are matched
+var statsCommands = []string{"stats"}
+
+func (sc *StatsCollector) handleRequest(req *protocol.Request) *protocol.Response {
+	cmd := strings.ToLower(req.Command)
+	if req.Version == 0 {
+		cmd = protocol.LegacyCommand(cmd, statsCommands)
+	}
+
+	switch cmd {
+	case "stats":
+		body := sc.GetAllStat()
+		if !json.Valid([]byte(body)) {
+			return protocol.ErrorResponse(protocol.StatusError, fmt.Errorf("%s", body))
+		}
+		return protocol.NewResponse(json.RawMessage(body))
+	}
+	return protocol.ErrorResponse(protocol.StatusNotFound, fmt.Errorf("Unknown command %s", req.Command))
+}
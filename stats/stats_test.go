@@ -11,6 +11,7 @@ package stats
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestStats(t *testing.T) {
@@ -82,3 +83,40 @@ func TestStats(t *testing.T) {
 	fmt.Printf(" Stats : %s", stats)
 
 }
+
+func TestStatFunc(t *testing.T) {
+	sc, err := NewStatsCollector("testfunc")
+	if err != nil {
+		t.Fatalf("Failed %s", err.Error())
+	}
+	sc.AddStatKey("Connections", 2)
+
+	calls := 0
+	// a stat computed from another one reads the collector
+	err = sc.AddStatFunc("Double", func() interface{} {
+		calls++
+		return sc.GetStat("Connections").(int) * 2
+	})
+	if err != nil || calls != 0 {
+		t.Errorf("Failed ! stat func called at registration %d %v", calls, err)
+	}
+
+	done := make(chan interface{})
+	go func() {
+		done <- sc.GetStat("Double")
+		sc.GetAllStat()
+		close(done)
+	}()
+	select {
+	case value := <-done:
+		<-done
+		if value != 4 {
+			t.Errorf("Failed ! unexpected value %v", value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Failed ! stat func deadlocked")
+	}
+	if err = sc.AddStatFunc("Double", func() interface{} { return 0 }); err == nil {
+		t.Errorf("Failed ! duplicate key added")
+	}
+}
@@ -0,0 +1,154 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// longer lines are split
+const MAX_LINE_SIZE = 1 << 20
+
+// Reads the lines appended to a file. The path is reopened when the file is
+// rotated, and reread from the start when truncated
+type tailer struct {
+	path    string // path followed, resolved inside the allowed roots on every open
+	file    *os.File
+	fi      os.FileInfo // identity of the open file
+	reader  *bufio.Reader
+	offset  int64 // of the next byte read
+	partial []byte
+	skip    bool // drop the first line, the offset is inside it
+}
+
+// Open a file for following. With relative set offset counts from the end
+// and following starts at the next line, otherwise offset is a position
+// reported with an earlier line; past the end the file was replaced and it
+// is read from the start
+func openTail(path string, offset int64, relative bool) (*tailer, error) {
+	t := &tailer{path: path}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+
+	size := t.fi.Size()
+	if relative {
+		if offset += size; offset < 0 {
+			offset = 0
+		}
+		if offset > 0 {
+			b := make([]byte, 1)
+			if _, err := t.file.ReadAt(b, offset-1); err == nil && b[0] != '\n' {
+				t.skip = true
+			}
+		}
+	} else if offset > size {
+		offset = 0
+	}
+	if _, err := t.file.Seek(offset, io.SeekStart); err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.reader.Reset(t.file)
+	t.offset = offset
+	return t, nil
+}
+
+// open the file at path, replacing the current one
+func (t *tailer) open() error {
+	file, fi, err := openFile(t.path, openFollow)
+	if err != nil {
+		return err
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file, t.fi, t.offset = file, fi, 0
+	t.reader = bufio.NewReader(file)
+	t.partial, t.skip = t.partial[:0], false
+	return nil
+}
+
+func (t *tailer) Close() error {
+	return t.file.Close()
+}
+
+// Pass the complete lines appended since the last read to emit, with the
+// offset following each line
+func (t *tailer) read(emit func(line string, offset int64) error) error {
+	for {
+		chunk, err := t.reader.ReadSlice('\n')
+		t.partial = append(t.partial, chunk...)
+		t.offset += int64(len(chunk))
+		switch {
+		case err == bufio.ErrBufferFull && len(t.partial) < MAX_LINE_SIZE:
+			continue
+		case err == io.EOF:
+			return nil
+		case err != nil && err != bufio.ErrBufferFull:
+			return err
+		}
+		if err = t.flush(emit); err != nil {
+			return err
+		}
+	}
+}
+
+// emit the pending line
+func (t *tailer) flush(emit func(line string, offset int64) error) error {
+	line := strings.TrimRight(string(t.partial), "\r\n")
+	t.partial = t.partial[:0]
+	if t.skip {
+		t.skip = false
+		return nil
+	}
+	return emit(line, t.offset)
+}
+
+// Check whether the path names a new file or the file was truncated. The rest
+// of a rotated file is read before switching to the new file. Returns true
+// when reading restarted from the beginning of a file
+func (t *tailer) reopen(emit func(line string, offset int64) error) (bool, error) {
+	fi, err := os.Stat(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// between the rename and the creation of the new file
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if os.SameFile(fi, t.fi) {
+		if fi.Size() >= t.offset {
+			return false, nil
+		}
+		if _, err = t.file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		t.reader.Reset(t.file)
+		t.offset, t.partial, t.skip = 0, t.partial[:0], false
+		return true, nil
+	}
+
+	if err = t.read(emit); err != nil {
+		return false, err
+	}
+	if len(t.partial) > 0 {
+		if err = t.flush(emit); err != nil {
+			return false, err
+		}
+	}
+	if err = t.open(); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -11,9 +11,10 @@
 package main
 
 import (
-	"net"
+	"os"
 )
 
-func connect(pathName string) (net.Conn, error) {
-	return net.Dial("unix", pathName)
+// open a file being followed
+func openFollow(path string) (*os.File, error) {
+	return os.Open(path)
 }
@@ -0,0 +1,127 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// minimum interval between checks of the certificate files
+const TLS_CHECK_INTERVAL = 5 * time.Second
+
+// Client certificate verification modes
+const (
+	CLIENT_AUTH_REQUIRE  = "require"  // connections without a valid certificate are refused
+	CLIENT_AUTH_OPTIONAL = "optional" // certificates are verified when given
+)
+
+// Serves the TLS configuration built from the certificate files, rebuilding
+// it when the files or the configured paths change. A configuration that
+// fails to load is reported and the previous one kept, so certificates can be
+// replaced one file at a time
+type tlsReloader struct {
+	mu       sync.Mutex
+	interval time.Duration
+	files    TLSConfig    // files of the current configuration
+	modTimes [3]time.Time // modification times of the files
+	checked  time.Time
+	config   *tls.Config
+}
+
+func newTLSReloader() *tlsReloader {
+	return &tlsReloader{interval: TLS_CHECK_INTERVAL}
+}
+
+func modTimes(files TLSConfig) [3]time.Time {
+	var times [3]time.Time
+	for i, path := range []string{files.CertFile, files.KeyFile, files.ClientCAFile} {
+		if fi, err := os.Stat(path); err == nil {
+			times[i] = fi.ModTime()
+		}
+	}
+	return times
+}
+
+// build a server configuration from certificate files
+func loadTLS(files TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load certificate %s", err.Error())
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if files.ClientCAFile != "" {
+		pem, err := os.ReadFile(files.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read client CA %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in client CA %s", files.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if files.ClientAuth == CLIENT_AUTH_OPTIONAL {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return config, nil
+}
+
+// Return the current configuration, reloading it if the files changed
+func (tr *tlsReloader) current() (*tls.Config, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	files := config().TLS
+	if files.CertFile == "" {
+		// TLS cannot be turned off without a restart
+		files = tr.files
+	}
+	if tr.config != nil && files == tr.files && time.Since(tr.checked) < tr.interval {
+		return tr.config, nil
+	}
+	tr.checked = time.Now()
+	times := modTimes(files)
+	if tr.config != nil && files == tr.files && times == tr.modTimes {
+		return tr.config, nil
+	}
+
+	config, err := loadTLS(files)
+	if err != nil {
+		if tr.config == nil {
+			return nil, err
+		}
+		rl.LogError("", DEFAULT, "TLS certificates not reloaded %s", err.Error())
+		return tr.config, nil
+	}
+	if tr.config != nil {
+		rl.LogInfo("", DEFAULT, "TLS certificates reloaded from %s", files.CertFile)
+	}
+	tr.config, tr.files, tr.modTimes = config, files, times
+	return config, nil
+}
+
+// Server configuration picking up certificate changes on new connections
+func (tr *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return tr.current()
+		},
+	}
+}
@@ -0,0 +1,242 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+var testSerial int64
+
+// issue a certificate signed by ca, self-signed if ca is nil
+func issueCert(t *testing.T, cn string, ca *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	parent, signer := tmpl, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write the certificate and key as PEM files
+func (tc *testCert) write(t *testing.T, certFile string, keyFile string) {
+	keyDer, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}), 0600); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	if keyFile != "" {
+		if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+			t.Fatalf("Failed ! %s", err.Error())
+		}
+	}
+}
+
+func (tc *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.der}, PrivateKey: tc.key}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, "test CA", nil, true)
+	ca.write(t, filepath.Join(dir, "ca.pem"), "")
+	issueCert(t, "server1", ca, false).write(t, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	client := issueCert(t, "grafana", ca, false)
+	stranger := issueCert(t, "stranger", issueCert(t, "other CA", nil, true), false)
+
+	cfg := defaultConfig()
+	cfg.RuntimeDir = testDir
+	cfg.TLS = TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+		ClientRole:   ROLE_READ,
+	}
+	cfg.Auth.TokensFile = writeConfig(t, `[{"name": "ops", "role": "admin", "token": "admin-token"}]`)
+	var err error
+	if cfg.authenticator, err = loadAuth(cfg.Auth); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	if err = cfg.validate(); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	setConfig(t, cfg)
+
+	tr := newTLSReloader()
+	tr.interval = 0
+	if _, err = tr.current(); err != nil {
+		t.Fatalf("Failed ! %s", err.Error())
+	}
+	srv := httptest.NewUnstartedServer(newHandler())
+	srv.TLS = tr.serverConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(cert *testCert, path string, header string) (*http.Response, error) {
+		method, body := "GET", ""
+		if path != "/modules" {
+			method, body = "POST", `{"Cmd":"rotate"}`
+		}
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{cert.tlsCert()}
+		}
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := httpClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// client certificates are required
+	if _, err = get(nil, "/modules", ""); err == nil {
+		t.Errorf("Failed ! expected handshake failure without a client certificate")
+	}
+	if _, err = get(stranger, "/modules", ""); err == nil {
+		t.Errorf("Failed ! expected handshake failure with an unknown CA")
+	}
+
+	// the certificate authenticates with the client role
+	resp, err := get(client, "/modules", "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed ! expected OK %v %v", resp, err)
+	}
+	if resp.TLS.PeerCertificates[0].Subject.CommonName != "server1" {
+		t.Errorf("Failed ! unexpected server certificate %s", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	if resp, err = get(client, "/logger/all", ""); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Failed ! expected forbidden %v %v", resp, err)
+	}
+	// a token takes precedence over the certificate
+	if resp, err = get(client, "/modules", "Bearer admin-token"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Failed ! expected OK %v %v", resp, err)
+	}
+	if resp, err = get(client, "/modules", "Bearer wrong"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Failed ! expected unauthorized %v %v", resp, err)
+	}
+
+	// new certificates are used by new connections
+	later := time.Now().Add(time.Minute)
+	issueCert(t, "server2", ca, false).write(t, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	os.Chtimes(filepath.Join(dir, "server.pem"), later, later)
+	if resp, err = get(client, "/modules", ""); err != nil || resp.TLS.PeerCertificates[0].Subject.CommonName != "server2" {
+		t.Errorf("Failed ! expected reloaded certificate %v", err)
+	}
+
+	// a broken certificate file keeps the current certificate
+	os.WriteFile(filepath.Join(dir, "server.pem"), []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "server.pem"), later, later)
+	if resp, err = get(client, "/modules", ""); err != nil || resp.TLS.PeerCertificates[0].Subject.CommonName != "server2" {
+		t.Errorf("Failed ! expected previous certificate %v", err)
+	}
+}
+
+func TestTLSOptionalClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, "test CA", nil, true)
+	ca.write(t, filepath.Join(dir, "ca.pem"), "")
+	issueCert(t, "server", ca, false).write(t, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+
+	cfg := defaultConfig()
+	cfg.RuntimeDir = testDir
+	cfg.TLS = TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+		ClientAuth:   CLIENT_AUTH_OPTIONAL,
+	}
+	setConfig(t, cfg)
+
+	tr := newTLSReloader()
+	srv := httptest.NewUnstartedServer(newHandler())
+	srv.TLS = tr.serverConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := httpClient.Get(srv.URL + "/modules")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed ! expected OK without client certificate %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	bad := cfg.TLS
+	bad.ClientAuth = "sometimes"
+	bad.ClientRole = "root"
+	cfg = defaultConfig()
+	cfg.TLS = bad
+	if err = cfg.validate(); err == nil {
+		t.Errorf("Failed ! expected invalid clientAuth and clientRole")
+	}
+
+	// a client role without auth would be ignored
+	noAuth := defaultConfig()
+	noAuth.RuntimeDir = testDir
+	noAuth.TLS = bad
+	noAuth.TLS.ClientAuth, noAuth.TLS.ClientRole = CLIENT_AUTH_OPTIONAL, ROLE_READ
+	if err = noAuth.validate(); err == nil || !strings.Contains(err.Error(), "clientRole requires auth") {
+		t.Errorf("Failed ! expected clientRole to require auth %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+//  Copyright 2012-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal server side of the WebSocket protocol (RFC 6455), enough to push
+// text messages to a client. Messages from the client are read and dropped
+const WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+const WEBSOCKET_WRITE_TIMEOUT = 10 * time.Second
+const MAX_WEBSOCKET_FRAME = 1 << 16
+
+// Frame opcodes
+const (
+	WS_TEXT  = 0x1
+	WS_CLOSE = 0x8
+	WS_PING  = 0x9
+	WS_PONG  = 0xA
+)
+
+// status sent in the close frame when the server ends the connection
+const WS_CLOSE_NORMAL = 1000
+
+type wsConn struct {
+	conn      net.Conn
+	rw        *bufio.ReadWriter
+	mu        sync.Mutex    // serialises frames
+	done      chan struct{} // closed when the client closes or the connection fails
+	closeOnce sync.Once
+}
+
+// check whether a header lists a token, e.g. Connection: keep-alive, Upgrade
+func headerHasToken(h http.Header, name string, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebSocket(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// Browsers do not apply CORS to WebSocket handshakes, any page could read the
+// streams. A browser origin must be the server itself or listed in
+// allowedOrigins; clients sending no origin are not browsers
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range config().AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete the opening handshake and take over the connection. Errors are
+// returned as *apiError before the connection is taken over
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !allowedOrigin(r) {
+		rl.LogWarn("", LOGGER, "Refused WebSocket from %s with origin %s", r.RemoteAddr, r.Header.Get("Origin"))
+		return nil, newAPIError(http.StatusForbidden, "Origin %s not allowed", r.Header.Get("Origin"))
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, newAPIError(http.StatusUpgradeRequired, "Unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		return nil, newAPIError(http.StatusBadRequest, "Invalid Sec-WebSocket-Key")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "WebSocket not supported: %s", err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &wsConn{conn: conn, rw: rw, done: make(chan struct{})}
+	go ws.readLoop()
+	return ws, nil
+}
+
+// Send a text message
+func (ws *wsConn) WriteText(text []byte) error {
+	return ws.writeFrame(WS_TEXT, text)
+}
+
+// send an unfragmented, unmasked frame
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	ws.conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	ws.rw.Write(header)
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+// read a frame from the client, which must be masked
+func (ws *wsConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.rw, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("Unmasked client frame")
+	}
+
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > MAX_WEBSOCKET_FRAME {
+		return 0, nil, fmt.Errorf("Frame size %d exceeds %d", size, MAX_WEBSOCKET_FRAME)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// answer pings and the close handshake until the client goes away
+func (ws *wsConn) readLoop() {
+	defer ws.closeOnce.Do(func() { close(ws.done) })
+	for {
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case WS_CLOSE:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			ws.writeFrame(WS_CLOSE, payload)
+			return
+		case WS_PING:
+			ws.writeFrame(WS_PONG, payload)
+		}
+	}
+}
+
+// Send a ping to keep the connection alive
+func (ws *wsConn) Ping() error {
+	return ws.writeFrame(WS_PING, nil)
+}
+
+// Channel closed when the client has gone away
+func (ws *wsConn) Done() <-chan struct{} {
+	return ws.done
+}
+
+// Close the connection, telling the client unless it closed it
+func (ws *wsConn) Close() error {
+	select {
+	case <-ws.done:
+	default:
+		ws.writeFrame(WS_CLOSE, binary.BigEndian.AppendUint16(nil, WS_CLOSE_NORMAL))
+	}
+	return ws.conn.Close()
+}